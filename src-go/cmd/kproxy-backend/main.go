@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"log"
 	"os"
@@ -19,9 +21,16 @@ func main() {
 		dataDir   = flag.String("data", getDefaultDataDir(), "Data directory for certificates and cache")
 		ipcPort   = flag.Int("ipc-port", 9090, "IPC server port")
 		proxyPort = flag.Int("proxy-port", 8080, "Proxy server port")
+		ipcToken  = flag.String("ipc-token", os.Getenv("KANTI_IPC_TOKEN"), "Token IPC clients must send (default $KANTI_IPC_TOKEN, or a random one)")
 	)
 	flag.Parse()
 
+	// Generate a token for this session if none was given
+	if *ipcToken == "" {
+		*ipcToken = newToken()
+		log.Printf("IPC token: %s\n", *ipcToken)
+	}
+
 	log.Println("Kanti Backend starting...")
 	log.Printf("Data directory: %s\n", *dataDir)
 	log.Printf("IPC port: %d\n", *ipcPort)
@@ -51,7 +60,7 @@ func main() {
 	log.Printf("Proxy server initialized (CA cert: %s)\n", proxyServer.GetCertificatePath())
 
 	// Initialize IPC server
-	ipcServer := ipc.NewServer(proxyServer, *ipcPort)
+	ipcServer := ipc.NewServer(proxyServer, *ipcPort, *ipcToken)
 
 	// Start IPC server in a goroutine
 	go func() {
@@ -99,3 +108,10 @@ func getDefaultDataDir() string {
 
 	return filepath.Join(home, ".kanti")
 }
+
+// newToken returns a random hex token
+func newToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -3,9 +3,17 @@ module github.com/1342tools/kanti/backend
 go 1.24.2
 
 require (
-	github.com/andybalholm/brotli v1.2.0 // indirect
-	github.com/elazarl/goproxy v1.7.2 // indirect
+	github.com/andybalholm/brotli v1.2.0
+	github.com/elazarl/goproxy v1.7.2
+	github.com/klauspost/compress v1.18.0
+	github.com/refraction-networking/utls v1.8.2
+	golang.org/x/net v0.38.0
+	software.sslmate.com/src/go-pkcs12 v0.5.0
+)
+
+require (
 	github.com/elazarl/goproxy/ext v0.0.0-20250305112401-088f758167d2 // indirect
-	golang.org/x/net v0.36.0 // indirect
-	golang.org/x/text v0.22.0 // indirect
+	golang.org/x/crypto v0.36.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
 )
@@ -0,0 +1,168 @@
+package ipc
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/1342tools/kanti/backend/internal/proxy"
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// handleCA describes the CA in use
+func (s *Server) handleCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendSuccess(w, s.proxyServer.GetCAInfo())
+}
+
+// handleCAHistory returns the CAs used so far, oldest first
+func (s *Server) handleCAHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendSuccess(w, s.proxyServer.GetCAHistory())
+}
+
+// handleCAExport serves the CA certificate as a file. GET exports the
+// certificate-only formats; PKCS#12 needs a POST carrying its password.
+func (s *Server) handleCAExport(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Format   string `json:"format"`   // One of the CAFormat* formats
+		Password string `json:"password"` // PKCS#12 password
+		Legacy   bool   `json:"legacy"`   // 3DES PKCS#12 for older devices
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		req.Format = r.URL.Query().Get("format")
+		if req.Format == models.CAFormatPKCS12 {
+			sendError(w, "PKCS#12 export requires a POST with a password", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if req.Format == "" {
+		req.Format = models.CAFormatPEM
+	}
+
+	data, err := s.proxyServer.ExportCA(req.Format, req.Password, req.Legacy)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType, filename := "application/x-pem-file", "kanti-ca.pem"
+	switch req.Format {
+	case models.CAFormatDER:
+		contentType, filename = "application/x-x509-ca-cert", "kanti-ca.cer"
+	case models.CAFormatPKCS12:
+		contentType, filename = "application/x-pkcs12", "kanti-ca.p12"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Write(data)
+}
+
+// handleCAImport replaces the CA with a PEM certificate and key, or a PKCS#12 file
+func (s *Server) handleCAImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Certificate string `json:"certificate"` // PEM, may also hold the key
+		PrivateKey  string `json:"privateKey"`  // PEM
+		PKCS12      []byte `json:"pkcs12"`      // Base64 encoded, instead of the PEM fields
+		Password    string `json:"password"`    // PKCS#12 password
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch {
+	case len(req.PKCS12) > 0:
+		err = s.proxyServer.ImportCAPKCS12(req.PKCS12, req.Password)
+	case req.Certificate != "":
+		err = s.proxyServer.ImportCA([]byte(req.Certificate), []byte(req.PrivateKey))
+	default:
+		sendError(w, "A certificate or PKCS#12 file is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sendSuccess(w, s.proxyServer.GetCAInfo())
+}
+
+// handleCARegenerate replaces the CA with a newly generated one
+func (s *Server) handleCARegenerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		CommonName         string `json:"commonName"`
+		Organization       string `json:"organization"`
+		OrganizationalUnit string `json:"organizationalUnit"`
+		Country            string `json:"country"`
+		ValidityDays       int    `json:"validityDays"` // 0 = 10 years
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ValidityDays < 0 {
+		sendError(w, "Validity must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	err := s.proxyServer.RegenerateCA(proxy.CAOptions{
+		CommonName:         req.CommonName,
+		Organization:       req.Organization,
+		OrganizationalUnit: req.OrganizationalUnit,
+		Country:            req.Country,
+		Validity:           time.Duration(req.ValidityDays) * 24 * time.Hour,
+	})
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccess(w, s.proxyServer.GetCAInfo())
+}
+
+// handleCAFlush drops the cached leaf certificates
+func (s *Server) handleCAFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.proxyServer.FlushCertificateCache()
+	sendSuccess(w, map[string]bool{"success": true})
+}
@@ -0,0 +1,129 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/1342tools/kanti/backend/internal/proxy"
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// handleInterceptQueue returns the items currently held by intercept mode
+func (s *Server) handleInterceptQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendSuccess(w, s.proxyServer.GetInterceptQueue())
+}
+
+// handleInterceptForward releases a held item, optionally with an edited raw message
+func (s *Server) handleInterceptForward(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := interceptID(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Raw string `json:"raw"`
+	}
+
+	// The body is optional; an empty body forwards the item as held
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.proxyServer.ForwardIntercepted(id, req.Raw); err != nil {
+		sendError(w, err.Error(), interceptErrorStatus(err))
+		return
+	}
+
+	sendSuccess(w, map[string]bool{"success": true})
+}
+
+// handleInterceptDrop discards a held item
+func (s *Server) handleInterceptDrop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := interceptID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.proxyServer.DropIntercepted(id); err != nil {
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	sendSuccess(w, map[string]bool{"success": true})
+}
+
+// handleInterceptEdit replaces the raw message of a held item without releasing it
+func (s *Server) handleInterceptEdit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := interceptID(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Raw string `json:"raw"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Raw == "" {
+		sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.proxyServer.EditIntercepted(id, req.Raw); err != nil {
+		sendError(w, err.Error(), interceptErrorStatus(err))
+		return
+	}
+
+	sendSuccess(w, map[string]bool{"success": true})
+}
+
+// handleInterceptEvent broadcasts intercept queue changes
+func (s *Server) handleInterceptEvent(eventType string, item models.InterceptedItem) {
+	s.broadcast(models.IPCEvent{
+		Type: eventType,
+		Data: item,
+	})
+}
+
+// interceptID parses the item ID from the request path
+func interceptID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		sendError(w, "Invalid intercept ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// interceptErrorStatus maps an intercept error to its HTTP status: items no
+// longer held are not found, rejected edits are bad requests
+func interceptErrorStatus(err error) int {
+	if errors.Is(err, proxy.ErrInterceptNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,45 @@
+package ipc
+
+import (
+	"net/http"
+)
+
+// handleListeners returns the status of every configured listener
+func (s *Server) handleListeners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendSuccess(w, s.proxyServer.GetListeners())
+}
+
+// handleListenerStart starts a single listener
+func (s *Server) handleListenerStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.proxyServer.StartListener(r.PathValue("id")); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccess(w, s.proxyServer.GetListeners())
+}
+
+// handleListenerStop stops a single listener
+func (s *Server) handleListenerStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.proxyServer.StopListener(r.PathValue("id")); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccess(w, s.proxyServer.GetListeners())
+}
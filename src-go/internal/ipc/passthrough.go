@@ -0,0 +1,37 @@
+package ipc
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handlePassthrough returns the hosts learned to reject the Kanti certificate
+func (s *Server) handlePassthrough(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendSuccess(w, s.proxyServer.GetPassthroughHosts())
+}
+
+// handlePassthroughRemove forgets a learned passthrough host, or all of them without a host
+func (s *Server) handlePassthroughRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Host string `json:"host"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.proxyServer.RemovePassthroughHost(req.Host)
+	sendSuccess(w, s.proxyServer.GetPassthroughHosts())
+}
@@ -1,21 +1,29 @@
 package ipc
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/1342tools/kanti/backend/internal/proxy"
 	"github.com/1342tools/kanti/backend/pkg/models"
 )
 
+// Host is the address the IPC server listens on. It only accepts local
+// connections as it can read and replace the CA private key.
+const Host = "127.0.0.1"
+
 // Server handles IPC communication with Electron
 type Server struct {
 	proxyServer *proxy.ProxyServer
 	httpServer  *http.Server
 	port        int
+	token       string // Required as a bearer token on every request
 	mu          sync.RWMutex
 
 	// Event channels for streaming events to clients
@@ -23,22 +31,38 @@ type Server struct {
 	eventClientsMu sync.RWMutex
 }
 
-// NewServer creates a new IPC server
-func NewServer(proxyServer *proxy.ProxyServer, port int) *Server {
+// NewServer creates a new IPC server that only serves requests carrying token
+func NewServer(proxyServer *proxy.ProxyServer, port int, token string) *Server {
 	s := &Server{
 		proxyServer:  proxyServer,
 		port:         port,
+		token:        token,
 		eventClients: make(map[chan models.IPCEvent]bool),
 	}
 
 	// Set up proxy event handlers
 	proxyServer.SetOnBatchFlush(s.handleBatchFlush)
+	proxyServer.SetOnResponseChunk(s.handleResponseChunk)
+	proxyServer.SetOnIntercept(s.handleInterceptEvent)
+	proxyServer.SetOnWebSocketMessage(s.handleWebSocketMessage)
+	proxyServer.SetOnTLSHandshakeFailure(s.handleTLSHandshakeFailure)
 
 	return s
 }
 
 // Start starts the IPC HTTP server
 func (s *Server) Start() error {
+	s.httpServer = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", Host, s.port),
+		Handler: s.handler(),
+	}
+
+	log.Printf("IPC server listening on %s:%d\n", Host, s.port)
+	return s.httpServer.ListenAndServe()
+}
+
+// handler routes the API endpoints behind the token check
+func (s *Server) handler() http.Handler {
 	mux := http.NewServeMux()
 
 	// API endpoints
@@ -48,18 +72,27 @@ func (s *Server) Start() error {
 	mux.HandleFunc("/api/proxy/config", s.handleConfig)
 	mux.HandleFunc("/api/proxy/requests", s.handleRequests)
 	mux.HandleFunc("/api/proxy/clear", s.handleClear)
+	mux.HandleFunc("/api/scope/check", s.handleScopeCheck)
+	mux.HandleFunc("/api/passthrough", s.handlePassthrough)
+	mux.HandleFunc("/api/passthrough/remove", s.handlePassthroughRemove)
+	mux.HandleFunc("/api/ca", s.handleCA)
+	mux.HandleFunc("/api/ca/history", s.handleCAHistory)
+	mux.HandleFunc("/api/ca/export", s.handleCAExport)
+	mux.HandleFunc("/api/ca/import", s.handleCAImport)
+	mux.HandleFunc("/api/ca/regenerate", s.handleCARegenerate)
+	mux.HandleFunc("/api/ca/flush", s.handleCAFlush)
+	mux.HandleFunc("/api/listeners", s.handleListeners)
+	mux.HandleFunc("/api/listeners/{id}/start", s.handleListenerStart)
+	mux.HandleFunc("/api/listeners/{id}/stop", s.handleListenerStop)
+	mux.HandleFunc("/api/intercept/queue", s.handleInterceptQueue)
+	mux.HandleFunc("/api/intercept/{id}/forward", s.handleInterceptForward)
+	mux.HandleFunc("/api/intercept/{id}/drop", s.handleInterceptDrop)
+	mux.HandleFunc("/api/intercept/{id}/edit", s.handleInterceptEdit)
+	mux.HandleFunc("/api/websockets", s.handleWebSockets)
+	mux.HandleFunc("/api/websockets/{id}/inject", s.handleWebSocketInject)
 	mux.HandleFunc("/api/events", s.handleEvents)
 
-	// Enable CORS for Electron
-	handler := corsMiddleware(mux)
-
-	s.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.port),
-		Handler: handler,
-	}
-
-	log.Printf("IPC server listening on port %d\n", s.port)
-	return s.httpServer.ListenAndServe()
+	return s.authMiddleware(mux)
 }
 
 // Stop stops the IPC server
@@ -70,15 +103,14 @@ func (s *Server) Stop() error {
 	return nil
 }
 
-// corsMiddleware adds CORS headers for Electron
-func corsMiddleware(next http.Handler) http.Handler {
+// authMiddleware rejects requests without the session token. Electron calls
+// the API from its main process, so no CORS headers are sent and browsers
+// cannot read responses or send the token from other origins.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			sendError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
@@ -105,7 +137,10 @@ func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
 	// Update config with port
 	config := s.proxyServer.GetConfig()
 	config.Port = req.Port
-	s.proxyServer.UpdateConfig(config)
+	if err := s.proxyServer.UpdateConfig(config); err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Start proxy
 	if err := s.proxyServer.Start(); err != nil {
@@ -141,6 +176,22 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	sendSuccess(w, s.proxyServer.GetStatus())
 }
 
+// handleScopeCheck reports whether a URL is in scope
+func (s *Server) handleScopeCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		sendError(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	sendSuccess(w, map[string]bool{"inScope": s.proxyServer.InScope(u)})
+}
+
 // handleConfig handles config get/update
 func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -154,7 +205,10 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		s.proxyServer.UpdateConfig(&config)
+		if err := s.proxyServer.UpdateConfig(&config); err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		sendSuccess(w, s.proxyServer.GetConfig())
 
 	default:
@@ -170,6 +224,18 @@ func (s *Server) handleRequests(w http.ResponseWriter, r *http.Request) {
 	}
 
 	requests := s.proxyServer.GetRequests()
+
+	// Optionally filter by the listener the requests came through
+	if listener := r.URL.Query().Get("listener"); listener != "" {
+		filtered := make([]models.RequestDetails, 0, len(requests))
+		for _, req := range requests {
+			if req.Listener == listener {
+				filtered = append(filtered, req)
+			}
+		}
+		requests = filtered
+	}
+
 	sendSuccess(w, requests)
 }
 
@@ -239,38 +305,49 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 
 // handleBatchFlush handles batch flush events from proxy
 func (s *Server) handleBatchFlush(requests []models.RequestDetails, responses []models.RequestDetails) {
-	s.eventClientsMu.RLock()
-	defer s.eventClientsMu.RUnlock()
-
 	// Broadcast request batch
 	if len(requests) > 0 {
-		event := models.IPCEvent{
+		s.broadcast(models.IPCEvent{
 			Type: "proxy-request-batch",
 			Data: requests,
-		}
-
-		for client := range s.eventClients {
-			select {
-			case client <- event:
-			default:
-				// Client buffer full, skip
-			}
-		}
+		})
 	}
 
 	// Broadcast response batch
 	if len(responses) > 0 {
-		event := models.IPCEvent{
+		s.broadcast(models.IPCEvent{
 			Type: "proxy-response-batch",
 			Data: responses,
-		}
+		})
+	}
+}
 
-		for client := range s.eventClients {
-			select {
-			case client <- event:
-			default:
-				// Client buffer full, skip
-			}
+// handleResponseChunk broadcasts a chunk of a streaming response
+func (s *Server) handleResponseChunk(chunk models.ResponseChunk) {
+	s.broadcast(models.IPCEvent{
+		Type: "proxy-response-chunk",
+		Data: chunk,
+	})
+}
+
+// handleTLSHandshakeFailure broadcasts a client that failed the TLS handshake with the proxy
+func (s *Server) handleTLSHandshakeFailure(failure models.TLSHandshakeFailure) {
+	s.broadcast(models.IPCEvent{
+		Type: "client-tls-error",
+		Data: failure,
+	})
+}
+
+// broadcast sends an event to all connected event clients
+func (s *Server) broadcast(event models.IPCEvent) {
+	s.eventClientsMu.RLock()
+	defer s.eventClientsMu.RUnlock()
+
+	for client := range s.eventClients {
+		select {
+		case client <- event:
+		default:
+			// Client buffer full, skip
 		}
 	}
 }
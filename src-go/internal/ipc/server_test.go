@@ -0,0 +1,112 @@
+package ipc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/1342tools/kanti/backend/internal/proxy"
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// TestCARoutesRequireToken checks that the routes reading or replacing the CA
+// private key reject requests without the session token
+func TestCARoutesRequireToken(t *testing.T) {
+	ps, err := proxy.NewProxyServer(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewServer(ps, 0, "secret").handler()
+	before := ps.GetCAInfo().SHA256
+
+	routes := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/api/ca/export", `{"format":"pkcs12","password":"x"}`},
+		{http.MethodPost, "/api/ca/import", `{"certificate":"x"}`},
+		{http.MethodPost, "/api/ca/regenerate", `{}`},
+		{http.MethodPost, "/api/ca/flush", ``},
+	}
+	headers := map[string]string{
+		"missing":   "",
+		"wrong":     "Bearer guess",
+		"no scheme": "secret",
+	}
+
+	for _, route := range routes {
+		for name, header := range headers {
+			t.Run(route.path+"/"+name, func(t *testing.T) {
+				req := httptest.NewRequest(route.method, route.path, strings.NewReader(route.body))
+				if header != "" {
+					req.Header.Set("Authorization", header)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+
+				if rec.Code != http.StatusUnauthorized {
+					t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+				}
+				if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+					t.Error("response allows cross-origin reads")
+				}
+			})
+		}
+	}
+
+	if after := ps.GetCAInfo().SHA256; after != before {
+		t.Fatal("CA changed by unauthorized requests")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/ca/flush", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status with token = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// TestConfigRejectsListenerIDs checks that configs whose listener IDs collide
+// with the default listener or with each other are rejected and not applied
+func TestConfigRejectsListenerIDs(t *testing.T) {
+	ps, err := proxy.NewProxyServer(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewServer(ps, 0, "secret").handler()
+
+	tests := []struct {
+		name      string
+		listeners string
+		want      int
+	}{
+		{"reserved", `[{"id":"default","port":8081,"mode":"regular"}]`, http.StatusBadRequest},
+		{"duplicate", `[{"id":"a","port":8081,"mode":"regular"},{"id":"a","port":8082,"mode":"socks"}]`, http.StatusBadRequest},
+		{"missing", `[{"port":8081,"mode":"regular"}]`, http.StatusBadRequest},
+		{"distinct", `[{"id":"a","port":8081,"mode":"regular"},{"id":"b","port":8082,"mode":"socks"}]`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"port":8080,"listeners":` + tt.listeners + `}`
+			req := httptest.NewRequest(http.MethodPost, "/api/proxy/config", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if rec.Code != http.StatusOK && len(ps.GetConfig().Listeners) != 0 {
+				t.Errorf("rejected listeners applied: %+v", ps.GetConfig().Listeners)
+			}
+		})
+	}
+
+	// The default listener stays the one on the proxy port
+	listeners := ps.GetListeners()
+	if len(listeners) != 3 || listeners[0].ID != models.DefaultListenerID || listeners[0].Port != 8080 {
+		t.Errorf("listeners = %+v", listeners)
+	}
+}
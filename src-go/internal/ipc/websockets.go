@@ -0,0 +1,85 @@
+package ipc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// handleWebSockets returns captured WebSocket messages, optionally for one handshake request
+func (s *Server) handleWebSockets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestID int
+	if value := r.URL.Query().Get("requestId"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			sendError(w, "Invalid request ID", http.StatusBadRequest)
+			return
+		}
+		requestID = id
+	}
+
+	sendSuccess(w, s.proxyServer.GetWebSocketMessages(requestID))
+}
+
+// handleWebSocketInject sends a new message over an open WebSocket connection
+func (s *Server) handleWebSocketInject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		sendError(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Direction string `json:"direction"`
+		Opcode    int    `json:"opcode"`  // Defaults to text
+		Payload   string `json:"payload"` // Text, or base64 with EncodingBase64
+		Encoding  string `json:"encoding"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	payload := []byte(req.Payload)
+	if req.Encoding == models.EncodingBase64 {
+		payload, err = base64.StdEncoding.DecodeString(req.Payload)
+		if err != nil {
+			sendError(w, "Invalid base64 payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	opcode := req.Opcode
+	if opcode == 0 {
+		opcode = 1
+	}
+
+	if err := s.proxyServer.InjectWebSocketMessage(requestID, req.Direction, opcode, payload); err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sendSuccess(w, map[string]bool{"success": true})
+}
+
+// handleWebSocketMessage broadcasts a captured WebSocket message
+func (s *Server) handleWebSocketMessage(msg models.WebSocketMessage) {
+	s.broadcast(models.IPCEvent{
+		Type: "websocket-message",
+		Data: msg,
+	})
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encodeBody renders captured bytes for JSON. UTF-8 text is kept as is and
+// anything else is base64 encoded so it survives the round trip unchanged.
+func encodeBody(data []byte) (string, string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), models.EncodingBase64
+}
+
+// decodeBody reverses encodeBody
+func decodeBody(data, encoding string) ([]byte, error) {
+	if encoding == models.EncodingBase64 {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	return []byte(data), nil
+}
+
+// decompressResponse undoes a Content-Encoding. Stacked encodings are listed
+// in the order they were applied, so they are decoded right to left. On an
+// error, the output decoded so far is returned with it.
+func decompressResponse(data []byte, encoding string) ([]byte, error) {
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+
+		decoded, err := decodeContent(data, coding)
+		if err != nil {
+			return decoded, fmt.Errorf("failed to decode %s content: %w", coding, err)
+		}
+		data = decoded
+	}
+
+	return data, nil
+}
+
+// decodeContent reverses a single content coding
+func decodeContent(data []byte, coding string) ([]byte, error) {
+	switch coding {
+	case "", "identity":
+		return data, nil
+
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return readDecoded(reader)
+
+	case "deflate":
+		// Meant to be zlib wrapped, but plenty of servers send raw deflate
+		if reader, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			defer reader.Close()
+			return readDecoded(reader)
+		}
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		return readDecoded(reader)
+
+	case "br":
+		return readDecoded(brotli.NewReader(bytes.NewReader(data)))
+
+	case "zstd":
+		return zstdDecoder.DecodeAll(data, nil)
+
+	default:
+		return nil, errors.New("unsupported content encoding")
+	}
+}
+
+// zstdDecoder is shared, DecodeAll is safe for concurrent use
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MaxBodySize))
+
+// readDecoded reads a decoder's output, refusing to inflate past MaxBodySize
+func readDecoded(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxBodySize+1))
+	if err != nil {
+		return data, err
+	}
+	if len(data) > MaxBodySize {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", MaxBodySize)
+	}
+	return data, nil
+}
+
+// errBodyTooLarge is returned when a body does not fit in memory for rewriting
+var errBodyTooLarge = fmt.Errorf("body exceeds %d bytes", MaxBodySize)
+
+// captureLimit returns how many bytes of each body are recorded
+func (ps *ProxyServer) captureLimit() int {
+	if limit := ps.GetConfig().MaxCaptureSize; limit > 0 {
+		return limit
+	}
+	return MaxBodySize
+}
+
+// peekBody reads up to limit bytes of a body and puts them back in front of
+// the rest, so the body is still forwarded in full. It reports whether the
+// body continues past limit.
+func peekBody(body *io.ReadCloser, limit int) ([]byte, bool, error) {
+	data, err := io.ReadAll(io.LimitReader(*body, int64(limit)+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	// An empty body is left alone so it keeps its framing
+	if len(data) == 0 {
+		return nil, false, nil
+	}
+
+	if len(data) <= limit {
+		(*body).Close()
+		*body = io.NopCloser(bytes.NewReader(data))
+		return data, false, nil
+	}
+
+	*body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), *body), *body}
+
+	return data[:limit], true, nil
+}
+
+// streamingContentTypes are responses delivered piece by piece over a long time
+var streamingContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/stream+json",
+	"multipart/x-mixed-replace",
+}
+
+// isStreamingResponse checks whether a response body is a long-lived stream
+func isStreamingResponse(resp *http.Response) bool {
+	return isStreamingContentType(resp.Header.Get("Content-Type"))
+}
+
+// isStreamingContentType checks a Content-Type against streamingContentTypes
+func isStreamingContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, t := range streamingContentTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// flushStreams serves h so that streaming responses reach the client as they
+// arrive. goproxy only flushes text/event-stream and chunked responses, and
+// the upstream Transfer-Encoding is gone by the time it checks.
+func flushStreams(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&streamWriter{ResponseWriter: w}, r)
+	})
+}
+
+// streamWriter flushes every write of a streaming response
+type streamWriter struct {
+	http.ResponseWriter
+	flush bool
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	w.flush = isStreamingContentType(w.Header().Get("Content-Type"))
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if w.flush && err == nil {
+		err = http.NewResponseController(w.ResponseWriter).Flush()
+	}
+	return n, err
+}
+
+func (w *streamWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack hands over the connection for CONNECT tunnels and WebSockets
+func (w *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// captureReader records a body as it is read, up to a limit
+type captureReader struct {
+	body      io.ReadCloser
+	limit     int
+	buf       bytes.Buffer
+	total     int64
+	truncated bool
+	err       error // Upstream failure that cut the body short
+
+	onChunk func(offset int64, chunk []byte) // Set for streaming bodies
+	onDone  func(c *captureReader)
+	once    sync.Once
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if n > 0 {
+		if room := c.limit - c.buf.Len(); n > room {
+			c.buf.Write(p[:room])
+			c.truncated = true
+		} else {
+			c.buf.Write(p[:n])
+		}
+		if c.onChunk != nil {
+			c.onChunk(c.total, p[:n])
+		}
+		c.total += int64(n)
+	}
+	if err != nil {
+		if err != io.EOF {
+			c.err = err
+		}
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *captureReader) Close() error {
+	err := c.body.Close()
+	c.finish()
+	return err
+}
+
+// finish reports the recorded body once, at EOF or when the body is closed
+func (c *captureReader) finish() {
+	c.once.Do(func() {
+		c.onDone(c)
+	})
+}
+
+// captureResponseBody records the response body while it is relayed to the
+// client and emits the response once the body is complete. Streaming
+// responses are emitted straight away and publish each chunk as it arrives.
+func (ps *ProxyServer) captureResponseBody(resp *http.Response, details models.RequestDetails, timing *upstreamTiming) {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		timing.apply(&details)
+		ps.emitResponse(details)
+		return
+	}
+
+	encoding := resp.Header.Get("Content-Encoding")
+	capture := &captureReader{
+		body:  resp.Body,
+		limit: ps.captureLimit(),
+		onDone: func(c *captureReader) {
+			details.ResponseLength = int(c.total)
+			details.ResponseTruncated = c.truncated
+
+			decompressed, err := decompressResponse(c.buf.Bytes(), encoding)
+			if err != nil && c.truncated && errors.Is(err, io.ErrUnexpectedEOF) {
+				// The capture stopped mid-stream, keep what decoded
+				err = nil
+			}
+			if err != nil {
+				// Keep the encoded bytes rather than losing the body
+				details.DecodeError = err.Error()
+				decompressed = c.buf.Bytes()
+			}
+			details.ResponseBody, details.ResponseBodyEncoding = encodeBody(decompressed)
+			if c.err != nil {
+				details.Error = c.err.Error()
+				details.ErrorType = classifyError(c.err)
+			}
+			timing.apply(&details)
+
+			ps.emitResponse(details)
+		},
+	}
+
+	if isStreamingResponse(resp) {
+		timing.apply(&details)
+		ps.emitResponse(details)
+		capture.onChunk = func(offset int64, chunk []byte) {
+			ps.emitResponseChunk(details.ID, offset, chunk)
+		}
+	}
+
+	resp.Body = capture
+}
+
+// emitResponseChunk publishes a piece of a streaming response body
+func (ps *ProxyServer) emitResponseChunk(reqID int, offset int64, chunk []byte) {
+	if ps.onResponseChunk == nil {
+		return
+	}
+
+	data, encoding := encodeBody(chunk)
+	ps.onResponseChunk(models.ResponseChunk{
+		RequestID: reqID,
+		Offset:    offset,
+		Data:      data,
+		Encoding:  encoding,
+		Timestamp: time.Now(),
+	})
+}
+
+// SetOnResponseChunk sets the callback for chunks of streaming responses
+func (ps *ProxyServer) SetOnResponseChunk(callback func(models.ResponseChunk)) {
+	ps.onResponseChunk = callback
+}
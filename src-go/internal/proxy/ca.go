@@ -0,0 +1,475 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// MaxCAHistory bounds the number of CAs kept in the history
+const MaxCAHistory = 50
+
+// CAOptions sets the subject and validity of a generated CA. Empty fields
+// take the values of the default Kanti CA.
+type CAOptions struct {
+	CommonName         string
+	Organization       string
+	OrganizationalUnit string
+	Country            string
+	Validity           time.Duration
+}
+
+// withDefaults fills the empty options with the default Kanti CA's values
+func (o CAOptions) withDefaults() CAOptions {
+	if o.CommonName == "" {
+		o.CommonName = "Kanti CA"
+	}
+	if o.Organization == "" {
+		o.Organization = "Kanti"
+	}
+	if o.OrganizationalUnit == "" {
+		o.OrganizationalUnit = "Kanti Certificate Authority"
+	}
+	if o.Country == "" {
+		o.Country = "US"
+	}
+	if o.Validity <= 0 {
+		o.Validity = 10 * 365 * 24 * time.Hour // 10 years
+	}
+	return o
+}
+
+// createCA generates a self-signed CA certificate and its key
+func createCA(opts CAOptions) (*x509.Certificate, crypto.Signer, error) {
+	opts = opts.withDefaults()
+
+	// Generate RSA key pair
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate RSA key: %w", err)
+	}
+
+	// Create certificate template
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	notBefore := time.Now()
+	notAfter := notBefore.Add(opts.Validity)
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:         opts.CommonName,
+			Country:            []string{opts.Country},
+			Organization:       []string{opts.Organization},
+			OrganizationalUnit: []string{opts.OrganizationalUnit},
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	// Create self-signed certificate
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	// Parse certificate
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	return cert, key, nil
+}
+
+// parseCertificatePEM parses the first certificate in PEM data
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode certificate PEM")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		return cert, nil
+	}
+}
+
+// parsePrivateKeyPEM parses the first private key in PEM data, which may be
+// PKCS#1 RSA, SEC 1 EC or PKCS#8
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode private key PEM")
+		}
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			continue
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, fmt.Errorf("encrypted private keys are not supported, import a PKCS#12 file instead")
+		}
+
+		var key any
+		var err error
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+}
+
+// validateCA checks that cert can sign leaf certificates with key
+func validateCA(cert *x509.Certificate, key crypto.Signer) error {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return errors.New("certificate is not a CA")
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("certificate is not allowed to sign certificates")
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate is only valid from %s to %s",
+			cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(cert.PublicKey) {
+		return errors.New("private key does not match the certificate")
+	}
+
+	return nil
+}
+
+// ImportCA replaces the CA with a PEM certificate and private key. keyPEM may
+// be empty if certPEM holds both.
+func (cm *CertificateManager) ImportCA(certPEM, keyPEM []byte) error {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return err
+	}
+
+	if len(keyPEM) == 0 {
+		keyPEM = certPEM
+	}
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return err
+	}
+
+	return cm.installCA(cert, key, models.CASourceImported)
+}
+
+// ImportPKCS12 replaces the CA with the certificate and key of a PKCS#12 file
+func (cm *CertificateManager) ImportPKCS12(data []byte, password string) error {
+	key, cert, _, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return fmt.Errorf("failed to decode PKCS#12: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return cm.installCA(cert, signer, models.CASourceImported)
+}
+
+// RegenerateCA replaces the CA with a newly generated one
+func (cm *CertificateManager) RegenerateCA(opts CAOptions) error {
+	cert, key, err := createCA(opts)
+	if err != nil {
+		return err
+	}
+
+	return cm.installCA(cert, key, models.CASourceGenerated)
+}
+
+// installCA validates, saves and switches to a new CA. Leaf certificates
+// signed by the previous CA are flushed.
+func (cm *CertificateManager) installCA(cert *x509.Certificate, key crypto.Signer, source string) error {
+	if err := validateCA(cert, key); err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if err := cm.saveCA(cert, key); err != nil {
+		return err
+	}
+
+	cm.caCert = cert
+	cm.caKey = key
+	cm.flushLeaves()
+
+	log.Printf("Switched to %s CA %s\n", source, cert.Subject)
+	if err := cm.recordCA(source, time.Now()); err != nil {
+		log.Printf("Warning: %v\n", err)
+	}
+	return nil
+}
+
+// FlushCertificateCache drops the cached leaf certificates, in memory and on disk
+func (cm *CertificateManager) FlushCertificateCache() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.flushLeaves()
+}
+
+// flushLeaves implements FlushCertificateCache. Caller must hold cm.mu.
+func (cm *CertificateManager) flushLeaves() {
+	cm.certs.clear()
+	if err := cm.removeLeaves(); err != nil {
+		log.Printf("Warning: failed to remove persisted certificates: %v\n", err)
+	}
+}
+
+// ExportCA encodes the CA certificate in one of the CAFormat* formats. PKCS#12
+// files also hold the private key and need a password; legacy selects the
+// 3DES encryption older Android, macOS and Windows versions require.
+func (cm *CertificateManager) ExportCA(format, password string, legacy bool) ([]byte, error) {
+	cm.mu.RLock()
+	cert, key := cm.caCert, cm.caKey
+	cm.mu.RUnlock()
+
+	switch format {
+	case models.CAFormatPEM:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), nil
+
+	case models.CAFormatDER:
+		return cert.Raw, nil
+
+	case models.CAFormatPKCS12:
+		if password == "" {
+			return nil, errors.New("a password is required to export the private key")
+		}
+
+		encoder := pkcs12.Modern
+		if legacy {
+			encoder = pkcs12.LegacyDES
+		}
+		data, err := encoder.Encode(key, cert, nil, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode PKCS#12: %w", err)
+		}
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("unknown CA format %q", format)
+}
+
+// GetCAInfo describes the CA in use
+func (cm *CertificateManager) GetCAInfo() models.CAInfo {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	return withExpiry(cm.history[len(cm.history)-1], time.Now())
+}
+
+// GetCAHistory returns the CAs used so far, oldest first
+func (cm *CertificateManager) GetCAHistory() []models.CAInfo {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	now := time.Now()
+	history := make([]models.CAInfo, len(cm.history))
+	for i, info := range cm.history {
+		history[i] = withExpiry(info, now)
+	}
+	return history
+}
+
+// withExpiry fills in the expiry status of a CA as of now
+func withExpiry(info models.CAInfo, now time.Time) models.CAInfo {
+	info.Expired = now.After(info.NotAfter)
+	info.DaysLeft = int(info.NotAfter.Sub(now).Hours() / 24)
+	return info
+}
+
+// recordCA makes the current CA the last history entry, retiring the previous
+// one, and saves the history. Caller must hold cm.mu or be initializing.
+func (cm *CertificateManager) recordCA(source string, activatedAt time.Time) error {
+	info := caInfo(cm.caCert)
+
+	if n := len(cm.history); n > 0 {
+		last := &cm.history[n-1]
+		if last.SHA256 == info.SHA256 {
+			return nil
+		}
+		if last.RetiredAt == nil {
+			last.RetiredAt = &activatedAt
+		}
+	}
+
+	info.Source = source
+	info.ActivatedAt = activatedAt
+	cm.history = append(cm.history, info)
+	if len(cm.history) > MaxCAHistory {
+		cm.history = cm.history[len(cm.history)-MaxCAHistory:]
+	}
+
+	data, err := json.MarshalIndent(cm.history, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode CA history: %w", err)
+	}
+	if err := writeFileAtomic(cm.historyPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write CA history: %w", err)
+	}
+	return nil
+}
+
+// loadHistory reads the saved CA history, if any
+func (cm *CertificateManager) loadHistory() error {
+	data, err := os.ReadFile(cm.historyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var history []models.CAInfo
+	if err := json.Unmarshal(data, &history); err != nil {
+		return err
+	}
+
+	// Describe each CA afresh from its certificate, only the history is kept
+	for _, entry := range history {
+		cert, err := parseCertificatePEM([]byte(entry.Certificate))
+		if err != nil {
+			return err
+		}
+
+		info := caInfo(cert)
+		info.Source = entry.Source
+		info.ActivatedAt = entry.ActivatedAt
+		info.RetiredAt = entry.RetiredAt
+		cm.history = append(cm.history, info)
+	}
+	return nil
+}
+
+// caInfo describes a CA certificate
+func caInfo(cert *x509.Certificate) models.CAInfo {
+	sha1Fingerprint := sha1.Sum(cert.Raw)
+	sha256Fingerprint := sha256.Sum256(cert.Raw)
+
+	return models.CAInfo{
+		Subject:      cert.Subject.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		KeyAlgorithm: cert.PublicKeyAlgorithm.String(),
+		SHA1:         hex.EncodeToString(sha1Fingerprint[:]),
+		SHA256:       hex.EncodeToString(sha256Fingerprint[:]),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		Certificate:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+	}
+}
+
+// writeFileAtomic replaces a file through a temporary file, so readers never
+// see it half written
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// GetCAInfo describes the CA in use
+func (ps *ProxyServer) GetCAInfo() models.CAInfo {
+	return ps.certMgr.GetCAInfo()
+}
+
+// GetCAHistory returns the CAs used so far, oldest first
+func (ps *ProxyServer) GetCAHistory() []models.CAInfo {
+	return ps.certMgr.GetCAHistory()
+}
+
+// ExportCA encodes the CA certificate in one of the CAFormat* formats
+func (ps *ProxyServer) ExportCA(format, password string, legacy bool) ([]byte, error) {
+	return ps.certMgr.ExportCA(format, password, legacy)
+}
+
+// ImportCA replaces the CA with a PEM certificate and private key
+func (ps *ProxyServer) ImportCA(certPEM, keyPEM []byte) error {
+	return ps.certMgr.ImportCA(certPEM, keyPEM)
+}
+
+// ImportCAPKCS12 replaces the CA with the contents of a PKCS#12 file
+func (ps *ProxyServer) ImportCAPKCS12(data []byte, password string) error {
+	return ps.certMgr.ImportPKCS12(data, password)
+}
+
+// RegenerateCA replaces the CA with a newly generated one
+func (ps *ProxyServer) RegenerateCA(opts CAOptions) error {
+	return ps.certMgr.RegenerateCA(opts)
+}
+
+// FlushCertificateCache drops the cached leaf certificates
+func (ps *ProxyServer) FlushCertificateCache() {
+	ps.certMgr.FlushCertificateCache()
+}
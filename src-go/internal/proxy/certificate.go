@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -8,31 +9,56 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"log"
 	"math/big"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+	"golang.org/x/net/publicsuffix"
 )
 
 // CertificateManager handles CA and server certificate generation
 type CertificateManager struct {
-	mu           sync.RWMutex
-	caKey        *rsa.PrivateKey
-	caCert       *x509.Certificate
-	certPath     string
-	keyPath      string
-	certCache    map[string]*tls.Certificate
-	cacheMaxSize int
+	mu       sync.RWMutex
+	caKey    crypto.Signer
+	caCert   *x509.Certificate
+	certPath string
+	keyPath  string
+	certs    *leafCache
+	leafDir  string // Persisted leaf certificates
+
+	pending       map[string]*leafCall // Certificates being issued, by cache key
+	leafKeyType   string               // One of the LeafKey* types
+	persistLeaves bool                 // Keep leaf certificates in leafDir across restarts
+	rsaKeys       keyPool
+
+	wildcards    bool                // Issue one wildcard certificate per parent domain
+	copySANs     bool                // Add the SANs of upstream certificates to leaves
+	upstreamSANs map[string][]string // SANs of the real certificate, by host
+
+	historyPath string
+	history     []models.CAInfo // CAs used so far, the last one is current
 }
 
+// MaxUpstreamSANHosts bounds the number of hosts whose upstream SANs are remembered
+const MaxUpstreamSANHosts = 1000
+
 // NewCertificateManager creates a new certificate manager
 func NewCertificateManager(dataDir string) (*CertificateManager, error) {
 	cm := &CertificateManager{
-		certCache:    make(map[string]*tls.Certificate),
-		cacheMaxSize: 100,
+		certs:        newLeafCache(DefaultLeafCacheSize),
+		leafDir:      filepath.Join(dataDir, "certificates", "leaves"),
+		upstreamSANs: make(map[string][]string),
+		pending:      make(map[string]*leafCall),
 		certPath:     filepath.Join(dataDir, "certificates", "ca.crt"),
 		keyPath:      filepath.Join(dataDir, "certificates", "ca.key"),
+		historyPath:  filepath.Join(dataDir, "certificates", "ca-history.json"),
 	}
 
 	// Ensure certificates directory exists
@@ -51,87 +77,72 @@ func NewCertificateManager(dataDir string) (*CertificateManager, error) {
 
 // initializeCA loads or generates the CA certificate
 func (cm *CertificateManager) initializeCA() error {
-	// Try to load existing CA certificate
-	if _, err := os.Stat(cm.certPath); err == nil {
-		if _, err := os.Stat(cm.keyPath); err == nil {
-			return cm.loadCA()
-		}
+	if err := cm.loadHistory(); err != nil {
+		log.Printf("Warning: failed to load CA history: %v\n", err)
 	}
 
-	// Generate new CA certificate
-	return cm.generateCA()
-}
+	source, activatedAt := models.CASourceGenerated, time.Now()
 
-// generateCA generates a new CA certificate
-func (cm *CertificateManager) generateCA() error {
-	// Generate RSA key pair
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return fmt.Errorf("failed to generate RSA key: %w", err)
-	}
+	// Try to load existing CA certificate
+	_, certErr := os.Stat(cm.certPath)
+	_, keyErr := os.Stat(cm.keyPath)
+	if certErr == nil && keyErr == nil {
+		if err := cm.loadCA(); err != nil {
+			return err
+		}
 
-	// Create certificate template
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-	if err != nil {
-		return fmt.Errorf("failed to generate serial number: %w", err)
+		// A CA that predates the history was in use since it was created
+		source = ""
+		if len(cm.history) == 0 {
+			activatedAt = cm.caCert.NotBefore
+		}
+	} else {
+		// Generate new CA certificate
+		if err := cm.generateCA(); err != nil {
+			return err
+		}
 	}
 
-	notBefore := time.Now()
-	notAfter := notBefore.Add(10 * 365 * 24 * time.Hour) // 10 years
-
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			CommonName:         "Kanti CA",
-			Country:            []string{"US"},
-			Organization:       []string{"Kanti"},
-			OrganizationalUnit: []string{"Kanti Certificate Authority"},
-		},
-		NotBefore:             notBefore,
-		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		IsCA:                  true,
+	if err := cm.recordCA(source, activatedAt); err != nil {
+		log.Printf("Warning: %v\n", err)
 	}
+	return nil
+}
 
-	// Create self-signed certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+// generateCA generates a new CA certificate with the default subject
+func (cm *CertificateManager) generateCA() error {
+	cert, key, err := createCA(CAOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to create certificate: %w", err)
+		return err
 	}
 
-	// Parse certificate
-	cert, err := x509.ParseCertificate(certDER)
-	if err != nil {
-		return fmt.Errorf("failed to parse certificate: %w", err)
+	if err := cm.saveCA(cert, key); err != nil {
+		return err
 	}
 
-	// Save certificate
-	certOut, err := os.Create(cm.certPath)
-	if err != nil {
-		return fmt.Errorf("failed to create certificate file: %w", err)
-	}
-	defer certOut.Close()
+	cm.caKey = key
+	cm.caCert = cert
 
-	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certDER}); err != nil {
-		return fmt.Errorf("failed to write certificate: %w", err)
-	}
+	return nil
+}
 
-	// Save private key
-	keyOut, err := os.OpenFile(cm.keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+// saveCA writes the CA certificate and its private key to the data directory
+func (cm *CertificateManager) saveCA(cert *x509.Certificate, key crypto.Signer) error {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
-		return fmt.Errorf("failed to create key file: %w", err)
+		return fmt.Errorf("failed to encode private key: %w", err)
 	}
-	defer keyOut.Close()
 
-	keyBytes := x509.MarshalPKCS1PrivateKey(key)
-	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: keyBytes}); err != nil {
+	// Write the key first, a certificate without its key is never left behind
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+	if err := writeFileAtomic(cm.keyPath, keyPEM, 0600); err != nil {
 		return fmt.Errorf("failed to write private key: %w", err)
 	}
 
-	cm.caKey = key
-	cm.caCert = cert
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := writeFileAtomic(cm.certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
 
 	return nil
 }
@@ -144,14 +155,9 @@ func (cm *CertificateManager) loadCA() error {
 		return fmt.Errorf("failed to read certificate: %w", err)
 	}
 
-	certBlock, _ := pem.Decode(certPEM)
-	if certBlock == nil {
-		return fmt.Errorf("failed to decode certificate PEM")
-	}
-
-	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	cert, err := parseCertificatePEM(certPEM)
 	if err != nil {
-		return fmt.Errorf("failed to parse certificate: %w", err)
+		return err
 	}
 
 	// Load private key
@@ -160,14 +166,9 @@ func (cm *CertificateManager) loadCA() error {
 		return fmt.Errorf("failed to read private key: %w", err)
 	}
 
-	keyBlock, _ := pem.Decode(keyPEM)
-	if keyBlock == nil {
-		return fmt.Errorf("failed to decode private key PEM")
-	}
-
-	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	key, err := parsePrivateKeyPEM(keyPEM)
 	if err != nil {
-		return fmt.Errorf("failed to parse private key: %w", err)
+		return err
 	}
 
 	cm.caKey = key
@@ -176,29 +177,83 @@ func (cm *CertificateManager) loadCA() error {
 	return nil
 }
 
-// GenerateServerCertificate generates a certificate for a specific domain
+// GenerateServerCertificate generates a certificate for a specific domain or IP address
 func (cm *CertificateManager) GenerateServerCertificate(domain string) (*tls.Certificate, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.Trim(domain, "[]")), ".")
+
 	cm.mu.RLock()
-	if cert, ok := cm.certCache[domain]; ok {
+	cacheKey, names := cm.leafNames(domain)
+	if cert, ok := cm.certs.get(cacheKey, time.Now()); ok {
 		cm.mu.RUnlock()
 		return cert, nil
 	}
 	cm.mu.RUnlock()
 
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
 
 	// Double-check after acquiring write lock
-	if cert, ok := cm.certCache[domain]; ok {
+	cacheKey, names = cm.leafNames(domain)
+	if cert, ok := cm.certs.get(cacheKey, time.Now()); ok {
+		cm.mu.Unlock()
 		return cert, nil
 	}
 
-	// Generate RSA key pair for server
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	// Wait for a handshake already issuing this certificate
+	if call, ok := cm.pending[cacheKey]; ok {
+		cm.mu.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+
+	call := &leafCall{done: make(chan struct{})}
+	cm.pending[cacheKey] = call
+	caCert, caKey, keyType, persist := cm.caCert, cm.caKey, cm.leafKeyType, cm.persistLeaves
+	cm.mu.Unlock()
+
+	// Keys are generated and leaves read from disk without the lock, so other
+	// hosts are not held up
+	var fromDisk bool
+	if persist {
+		call.cert, fromDisk = cm.loadLeaf(cacheKey, names, caCert, keyType)
+	}
+	if !fromDisk {
+		call.cert, call.err = cm.issueLeaf(names, caCert, caKey, keyType)
+		if call.err == nil && persist {
+			if err := cm.saveLeaf(cacheKey, call.cert); err != nil {
+				log.Printf("Warning: failed to persist certificate for %s: %v\n", cacheKey, err)
+			}
+		}
+	}
+
+	cm.mu.Lock()
+	delete(cm.pending, cacheKey)
+	if call.err == nil && cm.caCert == caCert {
+		cm.certs.add(cacheKey, call.cert)
+	}
+	cm.mu.Unlock()
+	close(call.done)
+
+	return call.cert, call.err
+}
+
+// leafCall is a leaf certificate being issued, shared by concurrent handshakes
+type leafCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// issueLeaf creates a leaf certificate for names signed by the given CA
+func (cm *CertificateManager) issueLeaf(names []string, caCert *x509.Certificate, caKey crypto.Signer, keyType string) (*tls.Certificate, error) {
+	key, err := cm.leafKey(keyType)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate server key: %w", err)
 	}
+	return signLeaf(names, key, caCert, caKey)
+}
 
+// signLeaf creates a leaf certificate for names and key, signed by the CA
+func signLeaf(names []string, key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer) (*tls.Certificate, error) {
 	// Create certificate template
 	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
@@ -208,48 +263,163 @@ func (cm *CertificateManager) GenerateServerCertificate(domain string) (*tls.Cer
 	notBefore := time.Now()
 	notAfter := notBefore.Add(365 * 24 * time.Hour) // 1 year
 
+	// Only RSA keys can encipher the key exchange
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			CommonName:         domain,
+			CommonName:         names[0],
 			Country:            []string{"US"},
 			Organization:       []string{"Kanti"},
 			OrganizationalUnit: []string{"Kanti Proxy Server"},
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              keyUsage,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		DNSNames:              []string{domain},
 	}
 
+	// IP hosts need IP SANs, clients never match them against DNS names
+	template.DNSNames, template.IPAddresses = splitNames(names)
+
 	// Create certificate signed by CA
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, cm.caCert, &key.PublicKey, cm.caKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, caCert, key.Public(), caKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create server certificate: %w", err)
 	}
 
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server certificate: %w", err)
+	}
+
 	// Create tls.Certificate
-	cert := &tls.Certificate{
-		Certificate: [][]byte{certDER, cm.caCert.Raw},
+	return &tls.Certificate{
+		Certificate: [][]byte{certDER, caCert.Raw},
 		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// splitNames separates the IP addresses among certificate names from the DNS names
+func splitNames(names []string) ([]string, []net.IP) {
+	var dnsNames []string
+	var ips []net.IP
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	return dnsNames, ips
+}
+
+// leafNames returns the cache key and SANs of the leaf certificate for host,
+// the first SAN naming the certificate. Caller must hold cm.mu.
+func (cm *CertificateManager) leafNames(host string) (string, []string) {
+	if cm.wildcards && net.ParseIP(host) == nil {
+		if parent, ok := wildcardParent(host); ok {
+			return "*." + parent, []string{"*." + parent, parent}
+		}
 	}
 
-	// Cache certificate (implement simple LRU by clearing cache when full)
-	if len(cm.certCache) >= cm.cacheMaxSize {
-		// Simple cache eviction - clear half the cache
-		for k := range cm.certCache {
-			delete(cm.certCache, k)
-			if len(cm.certCache) < cm.cacheMaxSize/2 {
-				break
+	names := []string{host}
+	if cm.copySANs {
+		for _, name := range cm.upstreamSANs[host] {
+			if name != host {
+				names = append(names, name)
 			}
 		}
 	}
+	return host, names
+}
 
-	cm.certCache[domain] = cert
+// leafCovers checks that every name is among the SANs of leaf
+func leafCovers(leaf *x509.Certificate, names []string) bool {
+	dnsNames, ips := splitNames(names)
+	for _, name := range dnsNames {
+		if !slices.Contains(leaf.DNSNames, name) {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if !slices.ContainsFunc(leaf.IPAddresses, ip.Equal) {
+			return false
+		}
+	}
+	return true
+}
 
-	return cert, nil
+// wildcardParent returns the domain whose wildcard certificate covers host.
+// Hosts directly below their registrable domain, and the registrable domain
+// itself, share *.registrable-domain; deeper hosts use their parent. Wildcards
+// are never issued directly below a public suffix.
+func wildcardParent(host string) (string, bool) {
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return "", false
+	}
+
+	if host == registrable {
+		return registrable, true
+	}
+
+	_, parent, _ := strings.Cut(host, ".")
+	return parent, true
+}
+
+// SetWildcardMode switches between exact and wildcard leaf certificates
+func (cm *CertificateManager) SetWildcardMode(enabled bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.wildcards = enabled
+}
+
+// SetCopyUpstreamSANs turns copying the SANs of upstream certificates into
+// leaf certificates on or off
+func (cm *CertificateManager) SetCopyUpstreamSANs(enabled bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.copySANs = enabled
+}
+
+// RememberUpstreamCertificate records the SANs of the real certificate for
+// host, so later leaf certificates for it carry the same names. The cached
+// leaf is only replaced if it lacks some of them.
+func (cm *CertificateManager) RememberUpstreamCertificate(host string, cert *x509.Certificate) {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	names := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses))
+	for _, name := range cert.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if !cm.copySANs || slices.Equal(cm.upstreamSANs[host], names) {
+		return
+	}
+
+	if len(cm.upstreamSANs) >= MaxUpstreamSANHosts {
+		clear(cm.upstreamSANs)
+	}
+	cm.upstreamSANs[host] = names
+
+	if cached, ok := cm.certs.get(host, time.Now()); ok && !leafCovers(cached.Leaf, names) {
+		cm.certs.remove(host)
+	}
 }
 
 // GetCACertificatePath returns the path to the CA certificate
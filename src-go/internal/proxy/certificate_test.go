@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// lockedInlineRSA issues leaves the way GenerateServerCertificate used to:
+// generating an RSA key inline while holding the manager's lock
+func lockedInlineRSA(cm *CertificateManager) func(host string) error {
+	var mu sync.Mutex
+	return func(host string) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		_, err = signLeaf([]string{host}, key, cm.caCert, cm.caKey)
+		return err
+	}
+}
+
+// issuer is a way of issuing leaves for new hosts the benchmarks compare
+type issuer struct {
+	issue func(host string) error
+	pool  *keyPool // RSA keys it draws from, if pooled
+}
+
+// issuers returns the current key types and the old locked inline RSA path
+func issuers(b *testing.B) map[string]issuer {
+	b.Helper()
+
+	issuers := make(map[string]issuer)
+	for _, keyType := range []string{models.LeafKeyRSA, models.LeafKeyECDSA} {
+		cm, err := NewCertificateManager(b.TempDir())
+		if err != nil {
+			b.Fatal(err)
+		}
+		cm.SetLeafKeyType(keyType)
+
+		issue := func(host string) error {
+			_, err := cm.GenerateServerCertificate(host)
+			return err
+		}
+		if keyType == models.LeafKeyRSA {
+			issuers[keyType] = issuer{issue: issue, pool: &cm.rsaKeys}
+			issuers["locked-inline-rsa"] = issuer{issue: lockedInlineRSA(cm)}
+		} else {
+			issuers[keyType] = issuer{issue: issue}
+		}
+	}
+	return issuers
+}
+
+// BenchmarkGenerateServerCertificate issues certificates for a steady stream
+// of new hosts from parallel handshakes. The RSA pool is drained after the
+// first KeyPoolSize hosts, so this measures the sustained rate.
+func BenchmarkGenerateServerCertificate(b *testing.B) {
+	issuers := issuers(b)
+	for _, name := range slices.Sorted(maps.Keys(issuers)) {
+		b.Run(name, func(b *testing.B) {
+			waitForFullPools(b, issuers)
+			var hosts atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := issuers[name].issue(fmt.Sprintf("host%d.example.com", hosts.Add(1))); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCertificateBurst issues certificates for KeyPoolSize new hosts at
+// once, like the first visit to a page with many subdomains. Each burst
+// starts with a full RSA pool; one op is one burst.
+func BenchmarkCertificateBurst(b *testing.B) {
+	issuers := issuers(b)
+	for _, name := range slices.Sorted(maps.Keys(issuers)) {
+		b.Run(name, func(b *testing.B) {
+			var hosts atomic.Int64
+			for range b.N {
+				b.StopTimer()
+				waitForFullPools(b, issuers)
+				b.StartTimer()
+
+				var wg sync.WaitGroup
+				for range KeyPoolSize {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if err := issuers[name].issue(fmt.Sprintf("host%d.example.com", hosts.Add(1))); err != nil {
+							b.Error(err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+// waitForFullPools lets the RSA key pools refill, starting unused ones, so
+// background key generation does not slow down the next measurement
+func waitForFullPools(b *testing.B, issuers map[string]issuer) {
+	b.Helper()
+
+	for _, issuer := range issuers {
+		pool := issuer.pool
+		if pool == nil {
+			continue
+		}
+		if pool.keys == nil {
+			pool.get()
+		}
+
+		for deadline := time.Now().Add(time.Minute); len(pool.keys) < KeyPoolSize; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				b.Fatal("RSA key pool did not fill")
+			}
+		}
+	}
+}
+
+// newTestCertificateManager creates a certificate manager storing its files in dir
+func newTestCertificateManager(t *testing.T, dir string) *CertificateManager {
+	t.Helper()
+
+	cm, err := NewCertificateManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.SetLeafKeyType(models.LeafKeyECDSA)
+	return cm
+}
+
+// mustLeaf issues or looks up the leaf certificate for host
+func mustLeaf(t *testing.T, cm *CertificateManager, host string) *x509.Certificate {
+	t.Helper()
+
+	cert, err := cm.GenerateServerCertificate(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf
+}
+
+func TestRememberUpstreamCertificate(t *testing.T) {
+	tests := []struct {
+		name     string
+		copySANs bool
+		upstream []string
+		reissue  bool
+		sans     []string
+	}{
+		{"disabled", false, []string{"www.example.com", "cdn.example.com"}, false, []string{"www.example.com"}},
+		{"nothing new", true, []string{"www.example.com"}, false, []string{"www.example.com"}},
+		{"new names", true, []string{"www.example.com", "cdn.example.com"}, true, []string{"www.example.com", "cdn.example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestCertificateManager(t, t.TempDir())
+			cm.SetCopyUpstreamSANs(tt.copySANs)
+
+			first := mustLeaf(t, cm, "www.example.com")
+			cm.RememberUpstreamCertificate("www.example.com", &x509.Certificate{DNSNames: tt.upstream})
+			second := mustLeaf(t, cm, "www.example.com")
+
+			if reissued := first.SerialNumber.Cmp(second.SerialNumber) != 0; reissued != tt.reissue {
+				t.Errorf("reissued = %v, want %v", reissued, tt.reissue)
+			}
+			if !slices.Equal(second.DNSNames, tt.sans) {
+				t.Errorf("SANs = %v, want %v", second.DNSNames, tt.sans)
+			}
+		})
+	}
+}
+
+func TestPersistedLeafSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	upstream := &x509.Certificate{DNSNames: []string{"www.example.com", "example.com", "cdn.example.com"}}
+
+	cm := newTestCertificateManager(t, dir)
+	cm.SetLeafCache(0, true)
+	cm.SetCopyUpstreamSANs(true)
+	mustLeaf(t, cm, "www.example.com")
+	cm.RememberUpstreamCertificate("www.example.com", upstream)
+	before := mustLeaf(t, cm, "www.example.com")
+
+	// Upstream SANs are not persisted, the saved leaf still covers the host
+	restarted := newTestCertificateManager(t, dir)
+	restarted.SetLeafCache(0, true)
+	restarted.SetCopyUpstreamSANs(true)
+	after := mustLeaf(t, restarted, "www.example.com")
+	if after.SerialNumber.Cmp(before.SerialNumber) != 0 {
+		t.Fatalf("leaf reissued after restart")
+	}
+
+	// Learning the same SANs again keeps the leaf
+	restarted.RememberUpstreamCertificate("www.example.com", upstream)
+	remembered := mustLeaf(t, restarted, "www.example.com")
+	if remembered.SerialNumber.Cmp(before.SerialNumber) != 0 {
+		t.Fatalf("leaf reissued after remembering known SANs")
+	}
+}
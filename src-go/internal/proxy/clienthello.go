@@ -0,0 +1,405 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// MaxTLSRecordSize is the largest TLS record a ClientHello can arrive in
+const MaxTLSRecordSize = 5 + 16384
+
+// ClientHello extension IDs that are parsed
+const (
+	extServerName        = 0x0000
+	extSupportedGroups   = 0x000a
+	extPointFormats      = 0x000b
+	extSignatureSchemes  = 0x000d
+	extALPN              = 0x0010
+	extSupportedVersions = 0x002b
+)
+
+var errMalformedHello = errors.New("malformed ClientHello")
+
+// clientHelloContextKey stores the client's ClientHello on requests read from a TLS connection
+type clientHelloContextKey struct{}
+
+// clientHelloFor returns the ClientHello of the connection a request came through
+func clientHelloFor(req *http.Request) *models.ClientHello {
+	hello, _ := req.Context().Value(clientHelloContextKey{}).(*models.ClientHello)
+	return hello
+}
+
+// clientHello holds the raw ClientHello fields fingerprints are built from
+type clientHello struct {
+	version          uint16
+	cipherSuites     []uint16
+	extensions       []uint16
+	supportedGroups  []uint16
+	pointFormats     []uint8
+	signatureSchemes []uint16
+	versions         []uint16
+	alpn             []string
+	serverName       string
+}
+
+// peekClientHello parses the ClientHello at the head of br without consuming it.
+// Only ClientHellos that fit in the first TLS record are recognized.
+func peekClientHello(br *bufio.Reader) (*models.ClientHello, error) {
+	header, err := br.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != 0x16 {
+		return nil, errMalformedHello
+	}
+
+	record, err := br.Peek(5 + (int(header[3])<<8 | int(header[4])))
+	if err != nil {
+		return nil, err
+	}
+
+	hello, err := parseClientHello(record[5:])
+	if err != nil {
+		return nil, err
+	}
+	return hello.summary(), nil
+}
+
+// parseClientHello parses a handshake message holding a ClientHello
+func parseClientHello(data []byte) (*clientHello, error) {
+	r := helloReader(data)
+
+	msgType, ok := r.u8()
+	if !ok || msgType != 1 {
+		return nil, errMalformedHello
+	}
+	length, ok := r.u24()
+	if !ok || length > len(r) {
+		return nil, errMalformedHello
+	}
+	r = r[:length]
+
+	h := &clientHello{}
+	var suites, extensions helloReader
+	if h.version, ok = r.u16(); !ok {
+		return nil, errMalformedHello
+	}
+	if _, ok = r.bytes(32); !ok { // random
+		return nil, errMalformedHello
+	}
+	if _, ok = r.vec8(); !ok { // session ID
+		return nil, errMalformedHello
+	}
+	if suites, ok = r.vec16(); !ok {
+		return nil, errMalformedHello
+	}
+	if _, ok = r.vec8(); !ok { // compression methods
+		return nil, errMalformedHello
+	}
+	h.cipherSuites = suites.u16s()
+
+	// Extensions are optional in old ClientHellos
+	if len(r) == 0 {
+		return h, nil
+	}
+	if extensions, ok = r.vec16(); !ok {
+		return nil, errMalformedHello
+	}
+
+	for len(extensions) > 0 {
+		id, ok := extensions.u16()
+		if !ok {
+			return nil, errMalformedHello
+		}
+		body, ok := extensions.vec16()
+		if !ok {
+			return nil, errMalformedHello
+		}
+		h.extensions = append(h.extensions, id)
+
+		switch id {
+		case extServerName:
+			list, _ := body.vec16()
+			for len(list) > 0 {
+				nameType, _ := list.u8()
+				name, ok := list.vec16()
+				if !ok {
+					break
+				}
+				if nameType == 0 {
+					h.serverName = string(name)
+				}
+			}
+		case extSupportedGroups:
+			list, _ := body.vec16()
+			h.supportedGroups = list.u16s()
+		case extPointFormats:
+			list, _ := body.vec8()
+			h.pointFormats = list
+		case extSignatureSchemes:
+			list, _ := body.vec16()
+			h.signatureSchemes = list.u16s()
+		case extALPN:
+			list, _ := body.vec16()
+			for len(list) > 0 {
+				proto, ok := list.vec8()
+				if !ok {
+					break
+				}
+				h.alpn = append(h.alpn, string(proto))
+			}
+		case extSupportedVersions:
+			list, _ := body.vec8()
+			h.versions = list.u16s()
+		}
+	}
+
+	return h, nil
+}
+
+// summary converts the parsed ClientHello into its model, computing fingerprints
+func (h *clientHello) summary() *models.ClientHello {
+	versions := withoutGREASE(h.versions)
+	if len(versions) == 0 {
+		versions = []uint16{h.version}
+	}
+
+	hello := &models.ClientHello{
+		ServerName:       h.serverName,
+		ALPN:             h.alpn,
+		Versions:         make([]string, 0, len(versions)),
+		CipherSuites:     make([]string, 0, len(h.cipherSuites)),
+		Extensions:       withoutGREASE(h.extensions),
+		SupportedGroups:  withoutGREASE(h.supportedGroups),
+		SignatureSchemes: h.signatureSchemes,
+		JA3:              h.ja3(),
+		JA4:              h.ja4(),
+	}
+
+	for _, v := range versions {
+		hello.Versions = append(hello.Versions, tls.VersionName(v))
+	}
+	for _, suite := range withoutGREASE(h.cipherSuites) {
+		hello.CipherSuites = append(hello.CipherSuites, tls.CipherSuiteName(suite))
+	}
+
+	sum := md5.Sum([]byte(hello.JA3))
+	hello.JA3Hash = hex.EncodeToString(sum[:])
+
+	return hello
+}
+
+// ja3 builds the JA3 string: version, ciphers, extensions, groups and point formats
+func (h *clientHello) ja3() string {
+	points := make([]uint16, len(h.pointFormats))
+	for i, p := range h.pointFormats {
+		points[i] = uint16(p)
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinDecimal(withoutGREASE(h.cipherSuites)),
+		joinDecimal(withoutGREASE(h.extensions)),
+		joinDecimal(withoutGREASE(h.supportedGroups)),
+		joinDecimal(points),
+	}, ",")
+}
+
+// ja4 builds the JA4 fingerprint (TCP), e.g. t13d1516h2_8daaf6152771_e5627efa2ab1
+func (h *clientHello) ja4() string {
+	version := h.version
+	for _, v := range withoutGREASE(h.versions) {
+		if v > version {
+			version = v
+		}
+	}
+
+	sni := "i"
+	if h.serverName != "" {
+		sni = "d"
+	}
+
+	suites := withoutGREASE(h.cipherSuites)
+	extensions := withoutGREASE(h.extensions)
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni,
+		min(len(suites), 99), min(len(extensions), 99), ja4ALPN(h.alpn))
+
+	// The SNI and ALPN extensions are already represented in the first part
+	hashed := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		if ext != extServerName && ext != extALPN {
+			hashed = append(hashed, ext)
+		}
+	}
+
+	c := joinSortedHex(hashed)
+	if len(h.signatureSchemes) > 0 {
+		c += "_" + joinHex(h.signatureSchemes)
+	}
+	if len(hashed) == 0 {
+		c = ""
+	}
+
+	return a + "_" + ja4Hash(joinSortedHex(suites)) + "_" + ja4Hash(c)
+}
+
+// ja4Version encodes a TLS version for JA4
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300: // SSL 3.0
+		return "s3"
+	}
+	return "00"
+}
+
+// ja4ALPN encodes the first and last character of the first ALPN value
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+
+	first, last := alpn[0][0], alpn[0][len(alpn[0])-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+
+	// Non-printable values use the first and last hex digit instead
+	encoded := hex.EncodeToString([]byte(alpn[0]))
+	return string([]byte{encoded[0], encoded[len(encoded)-1]})
+}
+
+// ja4Hash truncates the SHA-256 of a JA4 list to 12 hex characters
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinSortedHex(values []uint16) string {
+	sorted := append([]uint16(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return joinHex(sorted)
+}
+
+// helloReader consumes big-endian fields from a handshake message
+type helloReader []byte
+
+func (r *helloReader) bytes(n int) ([]byte, bool) {
+	if n > len(*r) {
+		return nil, false
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b, true
+}
+
+func (r *helloReader) u8() (uint8, bool) {
+	b, ok := r.bytes(1)
+	if !ok {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func (r *helloReader) u16() (uint16, bool) {
+	b, ok := r.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return uint16(b[0])<<8 | uint16(b[1]), true
+}
+
+func (r *helloReader) u24() (int, bool) {
+	b, ok := r.bytes(3)
+	if !ok {
+		return 0, false
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2]), true
+}
+
+// vec8 reads a vector with a one byte length prefix
+func (r *helloReader) vec8() (helloReader, bool) {
+	n, ok := r.u8()
+	if !ok {
+		return nil, false
+	}
+	b, ok := r.bytes(int(n))
+	return b, ok
+}
+
+// vec16 reads a vector with a two byte length prefix
+func (r *helloReader) vec16() (helloReader, bool) {
+	n, ok := r.u16()
+	if !ok {
+		return nil, false
+	}
+	b, ok := r.bytes(int(n))
+	return b, ok
+}
+
+// u16s reads the rest of r as a list of 16-bit values
+func (r helloReader) u16s() []uint16 {
+	values := make([]uint16, 0, len(r)/2)
+	for len(r) >= 2 {
+		v, _ := r.u16()
+		values = append(values, v)
+	}
+	return values
+}
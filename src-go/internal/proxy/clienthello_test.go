@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// helloSpec lists the ClientHello fields fingerprints are built from
+type helloSpec struct {
+	version          uint16
+	cipherSuites     []uint16
+	extensions       []uint16 // In wire order; bodies are filled in from the fields below
+	serverName       string
+	supportedGroups  []uint16
+	pointFormats     []uint8
+	signatureSchemes []uint16
+	alpn             []string
+	versions         []uint16
+}
+
+// record encodes the ClientHello as a TLS handshake record
+func (s helloSpec) record() []byte {
+	u16 := func(b []byte, v uint16) []byte { return append(b, byte(v>>8), byte(v)) }
+	vec8 := func(b, body []byte) []byte { return append(append(b, byte(len(body))), body...) }
+	vec16 := func(b, body []byte) []byte { return append(u16(b, uint16(len(body))), body...) }
+	u16s := func(values []uint16) []byte {
+		var b []byte
+		for _, v := range values {
+			b = u16(b, v)
+		}
+		return b
+	}
+
+	var extensions []byte
+	for _, id := range s.extensions {
+		var body []byte
+		switch id {
+		case extServerName:
+			body = vec16(nil, vec16([]byte{0}, []byte(s.serverName)))
+		case extSupportedGroups:
+			body = vec16(nil, u16s(s.supportedGroups))
+		case extPointFormats:
+			body = vec8(nil, s.pointFormats)
+		case extSignatureSchemes:
+			body = vec16(nil, u16s(s.signatureSchemes))
+		case extALPN:
+			var list []byte
+			for _, proto := range s.alpn {
+				list = vec8(list, []byte(proto))
+			}
+			body = vec16(nil, list)
+		case extSupportedVersions:
+			body = vec8(nil, u16s(s.versions))
+		}
+		extensions = vec16(u16(extensions, id), body)
+	}
+
+	hello := u16(nil, s.version)
+	hello = append(hello, make([]byte, 32)...) // random
+	hello = vec8(hello, nil)                   // session ID
+	hello = vec16(hello, u16s(s.cipherSuites))
+	hello = vec8(hello, []byte{0}) // null compression
+	hello = vec16(hello, extensions)
+
+	msg := append([]byte{1, byte(len(hello) >> 16), byte(len(hello) >> 8), byte(len(hello))}, hello...)
+	return vec16([]byte{0x16, 0x03, 0x01}, msg)
+}
+
+// ja4Chrome is the Chrome ClientHello from the JA4 specification's worked
+// example, which fingerprints as t13d1516h2_8daaf6152771_e5627efa2ab1
+var ja4Chrome = helloSpec{
+	version: 0x0303,
+	cipherSuites: []uint16{
+		0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9,
+		0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+	},
+	extensions: []uint16{
+		0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005,
+		0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015,
+	},
+	serverName:       "example.com",
+	supportedGroups:  []uint16{0x001d, 0x0017, 0x0018},
+	pointFormats:     []uint8{0},
+	signatureSchemes: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+	alpn:             []string{"h2", "http/1.1"},
+	versions:         []uint16{0x0304, 0x0303},
+}
+
+// withGREASE returns a copy of s with GREASE values (RFC 8701) placed the way
+// Chrome sends them
+func (s helloSpec) withGREASE() helloSpec {
+	s.cipherSuites = append([]uint16{0x0a0a}, s.cipherSuites...)
+	s.extensions = append(append([]uint16{0x1a1a}, s.extensions...), 0x2a2a)
+	s.supportedGroups = append([]uint16{0x3a3a}, s.supportedGroups...)
+	s.versions = append([]uint16{0x4a4a}, s.versions...)
+	return s
+}
+
+// withoutExtension returns a copy of s without the extension id
+func (s helloSpec) withoutExtension(id uint16) helloSpec {
+	var extensions []uint16
+	for _, ext := range s.extensions {
+		if ext != id {
+			extensions = append(extensions, ext)
+		}
+	}
+	s.extensions = extensions
+	return s
+}
+
+// TestClientHelloFingerprints checks JA3 and JA4 against the published
+// reference values
+func TestClientHelloFingerprints(t *testing.T) {
+	tests := []struct {
+		name    string
+		hello   helloSpec
+		ja3     string
+		ja3Hash string
+		ja4     string
+	}{
+		{
+			// The example from the JA3 README, which publishes no JA4
+			name: "ja3 reference",
+			hello: helloSpec{
+				version:         0x0301,
+				cipherSuites:    []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				extensions:      []uint16{0, 10, 11},
+				serverName:      "example.com",
+				supportedGroups: []uint16{23, 24, 25},
+				pointFormats:    []uint8{0},
+			},
+			ja3:     "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+			ja3Hash: "ada70206e40642a3e4461f35503241d5",
+			ja4:     "t10d120300_d94e65cdb899_33a13ba74d1c",
+		},
+		{
+			name:  "ja4 reference",
+			hello: ja4Chrome,
+			ja3:   "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			ja4:   "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name:  "grease",
+			hello: ja4Chrome.withGREASE(),
+			ja3:   "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			ja4:   "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			// SNI is counted in the first part but never hashed
+			name:  "no sni",
+			hello: ja4Chrome.withGREASE().withoutExtension(extServerName),
+			ja3:   "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			ja4:   "t13i1515h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name:  "no alpn",
+			hello: ja4Chrome.withoutExtension(extALPN),
+			ja3:   "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			ja4:   "t13d151500_8daaf6152771_e5627efa2ab1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := peekClientHello(bufio.NewReader(bytes.NewReader(tt.hello.record())))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if hello.JA3 != tt.ja3 {
+				t.Errorf("JA3 = %s\nwant   %s", hello.JA3, tt.ja3)
+			}
+			if tt.ja3Hash != "" && hello.JA3Hash != tt.ja3Hash {
+				t.Errorf("JA3 hash = %s, want %s", hello.JA3Hash, tt.ja3Hash)
+			}
+			if hello.JA4 != tt.ja4 {
+				t.Errorf("JA4 = %s, want %s", hello.JA4, tt.ja4)
+			}
+			if !slices.Contains(tt.hello.extensions, extServerName) && hello.ServerName != "" {
+				t.Errorf("ServerName = %q without an SNI extension", hello.ServerName)
+			}
+		})
+	}
+}
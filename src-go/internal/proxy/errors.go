@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// classifyError maps an upstream failure to one of the models.Error* types
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return models.ErrorDNS
+	}
+
+	if isTLSError(err) {
+		return models.ErrorTLS
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return models.ErrorTimeout
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return models.ErrorReset
+	}
+
+	var opErr *net.OpError
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) || (errors.As(err, &opErr) && opErr.Op == "dial") {
+		return models.ErrorConnect
+	}
+
+	// Upstream proxies report failures as text
+	if strings.Contains(err.Error(), "connection reset") {
+		return models.ErrorReset
+	}
+
+	return models.ErrorOther
+}
+
+// isTLSError checks whether err came from a TLS handshake or certificate check
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownAuthErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		strings.Contains(err.Error(), "tls: ")
+}
+
+// captureError records a request that failed before a response arrived
+func (ps *ProxyServer) captureError(req *http.Request, err error, reqID int64, startTime time.Time) models.RequestDetails {
+	return models.RequestDetails{
+		ID:           int(reqID),
+		Host:         req.Host,
+		Method:       req.Method,
+		Path:         req.URL.Path,
+		Query:        req.URL.RawQuery,
+		Headers:      req.Header.Clone(),
+		Timestamp:    startTime,
+		ResponseTime: time.Since(startTime).Milliseconds(),
+		Protocol:     requestProtocol(req),
+		HTTPVersion:  req.Proto,
+		ClientTLS:    clientHelloFor(req),
+		Error:        err.Error(),
+		ErrorType:    classifyError(err),
+	}
+}
+
+// emitTLSHandshakeFailure reports a client that failed the TLS handshake with the proxy
+func (ps *ProxyServer) emitTLSHandshakeFailure(conn net.Conn, serverName, target string, lc models.ListenerConfig, err error, addedToPassthrough bool) {
+	if ps.onTLSHandshakeFailure == nil {
+		return
+	}
+
+	ps.onTLSHandshakeFailure(models.TLSHandshakeFailure{
+		Timestamp:  time.Now(),
+		ClientAddr: conn.RemoteAddr().String(),
+		ServerName: serverName,
+		Target:     target,
+		Listener:   lc.ID,
+		Error:      err.Error(),
+
+		AddedToPassthrough: addedToPassthrough,
+	})
+}
+
+// SetOnTLSHandshakeFailure sets the callback for failed client TLS handshakes
+func (ps *ProxyServer) SetOnTLSHandshakeFailure(callback func(models.TLSHandshakeFailure)) {
+	ps.onTLSHandshakeFailure = callback
+}
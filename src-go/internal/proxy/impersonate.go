@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// fingerprintProfiles maps the Fingerprint* profiles to the ClientHellos they mimic
+var fingerprintProfiles = map[string]utls.ClientHelloID{
+	models.FingerprintChrome:  utls.HelloChrome_Auto,
+	models.FingerprintFirefox: utls.HelloFirefox_Auto,
+	models.FingerprintSafari:  utls.HelloSafari_Auto,
+}
+
+// fingerprintProfile returns the upstream ClientHello profile for a request,
+// the per-host rules taking precedence over the global setting
+func (ps *ProxyServer) fingerprintProfile(req *http.Request) string {
+	config := ps.GetConfig()
+	profile := config.TLSFingerprint
+
+	host := stripPort(req.URL.Host)
+rules:
+	for _, rule := range config.TLSFingerprintRules {
+		if !rule.Enabled {
+			continue
+		}
+		if len(rule.Hosts) == 0 {
+			profile = rule.Profile
+			break
+		}
+		for _, pattern := range rule.Hosts {
+			if matchesPattern(host, pattern) {
+				profile = rule.Profile
+				break rules
+			}
+		}
+	}
+
+	if profile == models.FingerprintAuto {
+		profile = browserFromUserAgent(req.UserAgent())
+	}
+	return profile
+}
+
+// browserFromUserAgent picks the profile closest to the browser in a User-Agent
+func browserFromUserAgent(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "Firefox/"):
+		return models.FingerprintFirefox
+	case strings.Contains(userAgent, "Chrome/") || strings.Contains(userAgent, "Chromium/"):
+		return models.FingerprintChrome
+	case strings.Contains(userAgent, "Safari/"):
+		return models.FingerprintSafari
+	}
+	return models.FingerprintGo
+}
+
+// impersonatorFor returns the transport sending req with a browser ClientHello,
+// or nil when req should use the regular transports
+func (ps *ProxyServer) impersonatorFor(req *http.Request) http.RoundTripper {
+	if req.URL.Scheme != "https" {
+		return nil
+	}
+
+	profile := ps.fingerprintProfile(req)
+	helloID, ok := fingerprintProfiles[profile]
+	if !ok {
+		return nil
+	}
+
+	ps.impersonatorsMu.Lock()
+	defer ps.impersonatorsMu.Unlock()
+
+	if ps.impersonators == nil {
+		ps.impersonators = make(map[string]*impersonatingTransport)
+	}
+	if t, ok := ps.impersonators[profile]; ok {
+		return t
+	}
+
+	t := newImpersonatingTransport(ps, helloID)
+	ps.impersonators[profile] = t
+	return t
+}
+
+// impersonatingTransport sends HTTPS requests over uTLS connections that
+// present a browser's ClientHello. Browsers offer h2 and HTTP/1.1 through ALPN,
+// so the protocol is only known after the handshake. Until it is known for an
+// address, requests dial up front and hand the connection to whichever
+// transport the server picked; later requests go straight to that transport.
+type impersonatingTransport struct {
+	ps      *ProxyServer
+	helloID utls.ClientHelloID
+
+	h1 *http.Transport
+	h2 *http2.Transport
+
+	mu        sync.Mutex
+	protocols map[string]string // Negotiated protocol by address
+}
+
+// dialedConnKey carries the connection a request dialed to learn the protocol,
+// so only the transport dialing for that request picks it up
+type dialedConnKey struct{}
+
+// dialedConn is a connection waiting for the transport of the request that dialed it
+type dialedConn struct {
+	mu   sync.Mutex
+	conn *impersonatedConn // nil once taken or closed
+}
+
+// take returns the connection if it negotiated protocol and was not taken yet
+func (d *dialedConn) take(protocol string) *impersonatedConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn == nil || d.conn.protocol() != protocol {
+		return nil
+	}
+	conn := d.conn
+	d.conn = nil
+	return conn
+}
+
+// close closes the connection unless a transport took it, e.g. because it
+// reused an idle or multiplexed connection instead of dialing
+func (d *dialedConn) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+// newImpersonatingTransport creates a transport mimicking helloID
+func newImpersonatingTransport(ps *ProxyServer, helloID utls.ClientHelloID) *impersonatingTransport {
+	t := &impersonatingTransport{
+		ps:        ps,
+		helloID:   helloID,
+		protocols: make(map[string]string),
+	}
+
+	t.h1 = &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			http1Only, _ := ctx.Value(http1OnlyKey{}).(bool)
+			return t.conn(ctx, addr, "http/1.1", http1Only)
+		},
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	t.h2 = &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return t.conn(ctx, addr, http2.NextProtoTLS, false)
+		},
+		DisableCompression: true,
+	}
+
+	return t
+}
+
+// http1OnlyKey marks requests whose connection must only offer HTTP/1.1
+type http1OnlyKey struct{}
+
+// RoundTrip sends req over the transport matching the protocol the server negotiates
+func (t *impersonatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := hostWithDefaultPort(req.URL.Host, "https")
+
+	// Remember the connection so HTTP/1.1 responses can report its TLS state
+	var gotConn net.Conn
+	var connMu sync.Mutex
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connMu.Lock()
+			defer connMu.Unlock()
+			gotConn = info.Conn
+		},
+	})
+
+	// WebSocket handshakes need HTTP/1.1, browsers dial them with ALPN http/1.1 only
+	upgrade := isWebSocketUpgrade(req.Header)
+	if upgrade {
+		ctx = context.WithValue(ctx, http1OnlyKey{}, true)
+	}
+
+	protocol := "http/1.1"
+	if !upgrade {
+		t.mu.Lock()
+		known, ok := t.protocols[addr]
+		t.mu.Unlock()
+
+		if ok {
+			protocol = known
+		} else {
+			conn, err := t.dial(ctx, addr, false)
+			if err != nil {
+				return nil, err
+			}
+			protocol = conn.protocol()
+
+			t.mu.Lock()
+			t.protocols[addr] = protocol
+			t.mu.Unlock()
+
+			dialed := &dialedConn{conn: conn}
+			defer dialed.close()
+			ctx = context.WithValue(ctx, dialedConnKey{}, dialed)
+		}
+	}
+	req = req.WithContext(ctx)
+
+	var resp *http.Response
+	var err error
+	if protocol == http2.NextProtoTLS {
+		resp, err = t.h2.RoundTrip(req)
+	} else {
+		resp, err = t.h1.RoundTrip(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	connMu.Lock()
+	defer connMu.Unlock()
+	if conn, ok := gotConn.(*impersonatedConn); ok && resp.TLS == nil {
+		resp.TLS = conn.state
+	}
+	return resp, nil
+}
+
+// conn returns a connection to addr for a transport, preferring the one the
+// request dialed in RoundTrip
+func (t *impersonatingTransport) conn(ctx context.Context, addr, protocol string, http1Only bool) (net.Conn, error) {
+	if dialed, ok := ctx.Value(dialedConnKey{}).(*dialedConn); ok && !http1Only {
+		if conn := dialed.take(protocol); conn != nil {
+			return conn, nil
+		}
+	}
+
+	conn, err := t.dial(ctx, addr, http1Only)
+	if err != nil {
+		return nil, err
+	}
+
+	if conn.protocol() != protocol {
+		// The server changed its mind, detect the protocol again next time
+		t.mu.Lock()
+		delete(t.protocols, addr)
+		t.mu.Unlock()
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s negotiated %s instead of %s", addr, conn.protocol(), protocol)
+	}
+	return conn, nil
+}
+
+// dial opens a uTLS connection to addr through the configured upstream proxies
+func (t *impersonatingTransport) dial(ctx context.Context, addr string, http1Only bool) (*impersonatedConn, error) {
+	rule, err := t.ps.upstreamRule(addr)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := dialUpstream(ctx, rule, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	uconn := utls.UClient(rawConn, &utls.Config{
+		ServerName:         stripPort(addr),
+		InsecureSkipVerify: true, // Like the regular transport, certificates are reported, not enforced
+	}, utls.HelloCustom)
+
+	spec, err := utls.UTLSIdToSpec(t.helloID)
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("failed to build %s ClientHello: %w", t.helloID.Str(), err)
+	}
+	if http1Only {
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = []string{"http/1.1"}
+			}
+		}
+	}
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("failed to apply %s ClientHello: %w", t.helloID.Str(), err)
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, UpstreamDialTimeout)
+	defer cancel()
+	err = uconn.HandshakeContext(ctx)
+
+	state := convertConnectionState(uconn.ConnectionState())
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(*state, err)
+	}
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("tls: upstream handshake with %s: %w", addr, err)
+	}
+
+	return &impersonatedConn{UConn: uconn, state: state}, nil
+}
+
+// impersonatedConn is a completed uTLS connection. It reports its state as a
+// crypto/tls ConnectionState so the HTTP/2 transport and captures can use it.
+type impersonatedConn struct {
+	*utls.UConn
+	state *tls.ConnectionState
+}
+
+func (c *impersonatedConn) ConnectionState() tls.ConnectionState {
+	return *c.state
+}
+
+// protocol returns the negotiated ALPN protocol, HTTP/1.1 if there was none
+func (c *impersonatedConn) protocol() string {
+	if c.state.NegotiatedProtocol == http2.NextProtoTLS {
+		return http2.NextProtoTLS
+	}
+	return "http/1.1"
+}
+
+// convertConnectionState copies a uTLS connection state into its crypto/tls equivalent
+func convertConnectionState(s utls.ConnectionState) *tls.ConnectionState {
+	return &tls.ConnectionState{
+		Version:                     s.Version,
+		HandshakeComplete:           s.HandshakeComplete,
+		DidResume:                   s.DidResume,
+		CipherSuite:                 s.CipherSuite,
+		NegotiatedProtocol:          s.NegotiatedProtocol,
+		NegotiatedProtocolIsMutual:  true,
+		ServerName:                  s.ServerName,
+		PeerCertificates:            s.PeerCertificates,
+		VerifiedChains:              s.VerifiedChains,
+		SignedCertificateTimestamps: s.SignedCertificateTimestamps,
+		OCSPResponse:                s.OCSPResponse,
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// TestImpersonatingTransportConnections checks that the connection dialed to
+// learn the protocol is used by the request that dialed it, and that the ones
+// a transport had no use for are closed
+func TestImpersonatingTransportConnections(t *testing.T) {
+	for _, h2 := range []bool{false, true} {
+		name := "http/1.1"
+		if h2 {
+			name = "h2"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			open := make(map[net.Conn]bool)
+			dialed := 0
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(50 * time.Millisecond) // Keep concurrent requests from sharing HTTP/1.1 connections
+				io.WriteString(w, r.Proto)
+			}))
+			server.EnableHTTP2 = h2
+			server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch state {
+				case http.StateNew:
+					open[conn] = true
+					dialed++
+				case http.StateClosed, http.StateHijacked:
+					delete(open, conn)
+				}
+			}
+			server.StartTLS()
+			defer server.Close()
+
+			ps, err := NewProxyServer(t.TempDir(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport := newImpersonatingTransport(ps, utls.HelloChrome_Auto)
+
+			get := func() {
+				req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+				resp, err := transport.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			// A first request uses the connection it dialed
+			get()
+			get()
+			mu.Lock()
+			if dialed != 1 {
+				t.Errorf("sequential requests dialed %d connections, want 1", dialed)
+			}
+			mu.Unlock()
+
+			// Concurrent first requests close the connections left unused
+			transport = newImpersonatingTransport(ps, utls.HelloChrome_Auto)
+			var wg sync.WaitGroup
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					get()
+				}()
+			}
+			wg.Wait()
+			transport.h1.CloseIdleConnections()
+			transport.h2.CloseIdleConnections()
+
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				mu.Lock()
+				// Only the connection of the first transport may remain
+				remaining := len(open)
+				mu.Unlock()
+				if remaining <= 1 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%d connections left open", remaining)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,546 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	DefaultInterceptTimeout = 5 * time.Minute
+
+	InterceptActionForward = "forward"
+	InterceptActionDrop    = "drop"
+	InterceptActionTimeout = "timeout"
+)
+
+// ErrInterceptNotFound is returned for items that are no longer held
+var ErrInterceptNotFound = errors.New("not held")
+
+// interceptDecision is the outcome of a held item
+type interceptDecision struct {
+	action  string
+	raw     []byte // Edited message, nil if unchanged
+	expired bool   // Nobody decided in time, action is the timeout action
+}
+
+// pendingIntercept is an item waiting for a decision
+type pendingIntercept struct {
+	item     models.InterceptedItem
+	edited   []byte
+	validate func(raw []byte) error // Checks an edit before it is accepted
+	decision chan interceptDecision
+}
+
+// interceptQueue holds requests and responses until they are forwarded or dropped
+type interceptQueue struct {
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]*pendingIntercept
+
+	onEvent func(eventType string, item models.InterceptedItem)
+}
+
+// newInterceptQueue creates an empty intercept queue
+func newInterceptQueue() *interceptQueue {
+	return &interceptQueue{
+		pending: make(map[int64]*pendingIntercept),
+	}
+}
+
+// hold parks an item until a decision is made, the timeout expires or done is
+// closed. Edits are only accepted if validate passes them.
+func (q *interceptQueue) hold(item models.InterceptedItem, validate func([]byte) error, timeout time.Duration, timeoutAction string, done <-chan struct{}) interceptDecision {
+	q.mu.Lock()
+	q.nextID++
+	item.ID = q.nextID
+	item.Timestamp = time.Now()
+	item.ExpiresAt = item.Timestamp.Add(timeout)
+	p := &pendingIntercept{
+		item:     item,
+		validate: validate,
+		decision: make(chan interceptDecision, 1),
+	}
+	q.pending[item.ID] = p
+	q.mu.Unlock()
+
+	q.emit("intercept-added", item)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var decision interceptDecision
+	select {
+	case decision = <-p.decision:
+	case <-timer.C:
+		decision = q.expire(p, timeoutAction)
+	case <-done:
+		// Client went away, nothing left to forward to
+		decision = q.expire(p, InterceptActionDrop)
+	}
+
+	return decision
+}
+
+// expire removes an item that was not resolved in time
+func (q *interceptQueue) expire(p *pendingIntercept, action string) interceptDecision {
+	q.mu.Lock()
+	if q.pending[p.item.ID] != p {
+		q.mu.Unlock()
+		// Resolved concurrently, the decision is on its way
+		return <-p.decision
+	}
+	delete(q.pending, p.item.ID)
+	edited := p.edited
+	q.mu.Unlock()
+
+	if action != InterceptActionDrop {
+		action = InterceptActionForward
+	}
+
+	item := p.item
+	item.Action = InterceptActionTimeout
+	q.emit("intercept-resolved", item)
+
+	return interceptDecision{action: action, raw: edited, expired: true}
+}
+
+// resolve delivers a decision to a held item. An invalid edit is rejected and
+// leaves the item held.
+func (q *interceptQueue) resolve(id int64, action string, raw []byte) error {
+	q.mu.Lock()
+	p, ok := q.pending[id]
+	if !ok {
+		q.mu.Unlock()
+		return fmt.Errorf("intercepted item %d: %w", id, ErrInterceptNotFound)
+	}
+	if raw != nil && action != InterceptActionDrop && p.validate != nil {
+		if err := p.validate(raw); err != nil {
+			q.mu.Unlock()
+			return err
+		}
+	}
+	delete(q.pending, id)
+	q.mu.Unlock()
+
+	if raw == nil {
+		raw = p.edited
+	}
+
+	item := p.item
+	item.Action = action
+	if raw != nil {
+		item.Raw = string(raw)
+		item.Edited = true
+	}
+
+	p.decision <- interceptDecision{action: action, raw: raw}
+	q.emit("intercept-resolved", item)
+
+	return nil
+}
+
+// edit replaces the held message without releasing it. An invalid edit is
+// rejected and the previous message kept.
+func (q *interceptQueue) edit(id int64, raw []byte) error {
+	q.mu.Lock()
+	p, ok := q.pending[id]
+	if !ok {
+		q.mu.Unlock()
+		return fmt.Errorf("intercepted item %d: %w", id, ErrInterceptNotFound)
+	}
+	if p.validate != nil {
+		if err := p.validate(raw); err != nil {
+			q.mu.Unlock()
+			return err
+		}
+	}
+	p.edited = raw
+	p.item.Raw = string(raw)
+	p.item.Edited = true
+	item := p.item
+	q.mu.Unlock()
+
+	q.emit("intercept-updated", item)
+
+	return nil
+}
+
+// releaseAll forwards every held item, used when intercept mode is turned off
+func (q *interceptQueue) releaseAll() {
+	for _, item := range q.list() {
+		q.resolve(item.ID, InterceptActionForward, nil)
+	}
+}
+
+// releaseType forwards every held item of one type
+func (q *interceptQueue) releaseType(itemType string) {
+	for _, item := range q.list() {
+		if item.Type == itemType {
+			q.resolve(item.ID, InterceptActionForward, nil)
+		}
+	}
+}
+
+// list returns the held items (oldest first)
+func (q *interceptQueue) list() []models.InterceptedItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := make([]models.InterceptedItem, 0, len(q.pending))
+	for _, p := range q.pending {
+		items = append(items, p.item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+
+	return items
+}
+
+// setOnEvent sets the callback for queue events
+func (q *interceptQueue) setOnEvent(callback func(string, models.InterceptedItem)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.onEvent = callback
+}
+
+// emit sends an intercept event to the callback if set
+func (q *interceptQueue) emit(eventType string, item models.InterceptedItem) {
+	q.mu.Lock()
+	onEvent := q.onEvent
+	q.mu.Unlock()
+
+	if onEvent != nil {
+		onEvent(eventType, item)
+	}
+}
+
+// interceptTimeout returns the configured hold timeout
+func interceptTimeout(cfg models.InterceptConfig) time.Duration {
+	if cfg.TimeoutSeconds > 0 {
+		return time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	return DefaultInterceptTimeout
+}
+
+// shouldIntercept checks whether a request should be held for review
+func shouldIntercept(cfg models.InterceptConfig, req *http.Request) bool {
+	if !interceptsHost(cfg, req.Host) {
+		return false
+	}
+
+	// Auto-forward rules
+	for _, method := range cfg.AutoForwardMethods {
+		if strings.EqualFold(req.Method, method) {
+			return false
+		}
+	}
+
+	ext := strings.ToLower(path.Ext(req.URL.Path))
+	if ext != "" {
+		for _, e := range cfg.AutoForwardExtensions {
+			e = strings.ToLower(e)
+			if !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			if ext == e {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// interceptsHost checks whether intercept mode applies to a host
+func interceptsHost(cfg models.InterceptConfig, host string) bool {
+	if !cfg.Enabled {
+		return false
+	}
+
+	if len(cfg.Hosts) > 0 {
+		matched := false
+		for _, pattern := range cfg.Hosts {
+			if matchesPattern(host, pattern) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for _, pattern := range cfg.AutoForwardHosts {
+		if matchesPattern(host, pattern) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dumpRequest serializes a request in raw HTTP/1.1 form, buffering the body
+func dumpRequest(req *http.Request) ([]byte, error) {
+	body, err := readAndRestoreBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(&buf, "Host: %s\r\n", req.Host)
+	if err := req.Header.WriteSubset(&buf, map[string]bool{"Host": true}); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// dumpResponse serializes a response in raw HTTP/1.1 form, buffering the body
+func dumpResponse(resp *http.Response) ([]byte, error) {
+	body, err := readAndRestoreBody(&resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	status := strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" ")
+	if status == "" {
+		status = http.StatusText(resp.StatusCode)
+	}
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", resp.StatusCode, status)
+	if err := resp.Header.Write(&buf); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// readAndRestoreBody buffers a body of up to MaxBodySize. Larger bodies are
+// left to stream through unchanged and return errBodyTooLarge.
+func readAndRestoreBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+
+	data, more, err := peekBody(body, MaxBodySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if more {
+		return nil, errBodyTooLarge
+	}
+
+	return data, nil
+}
+
+// splitRawMessage separates the head of a raw HTTP message from its body
+func splitRawMessage(raw []byte) ([]byte, []byte) {
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[:i+4], raw[i+4:]
+	}
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		return raw[:i+2], raw[i+2:]
+	}
+	return append(raw, "\r\n\r\n"...), nil
+}
+
+// parseRawRequest rebuilds a request from edited raw text, keeping the original target
+func parseRawRequest(raw []byte, orig *http.Request) (*http.Request, error) {
+	head, body := splitRawMessage(raw)
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse edited request: %w", err)
+	}
+
+	// Edited requests are sent to the same origin; only the Host header may change
+	req.URL.Scheme = orig.URL.Scheme
+	req.URL.Host = orig.URL.Host
+	req.RequestURI = ""
+	req.RemoteAddr = orig.RemoteAddr
+
+	setRawBody(req.Header, &req.Body, &req.ContentLength, body)
+	req.TransferEncoding = nil
+
+	return req.WithContext(orig.Context()), nil
+}
+
+// parseRawResponse rebuilds a response from edited raw text
+func parseRawResponse(raw []byte, orig *http.Response) (*http.Response, error) {
+	head, body := splitRawMessage(raw)
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), orig.Request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse edited response: %w", err)
+	}
+
+	setRawBody(resp.Header, &resp.Body, &resp.ContentLength, body)
+	resp.TransferEncoding = nil
+
+	return resp, nil
+}
+
+// setRawBody installs an edited body and fixes up the framing headers to match it
+func setRawBody(header http.Header, rc *io.ReadCloser, contentLength *int64, body []byte) {
+	header.Del("Transfer-Encoding")
+	if len(body) > 0 || header.Get("Content-Length") != "" {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	*rc = io.NopCloser(bytes.NewReader(body))
+	*contentLength = int64(len(body))
+}
+
+// interceptRequest holds a request in the queue and applies the decision,
+// returning the request to send and the InterceptAction* it was resolved with.
+// A non-nil response means the request was dropped and must not be sent.
+func (ps *ProxyServer) interceptRequest(req *http.Request, reqID int64) (*http.Request, *http.Response, string) {
+	cfg := ps.GetConfig().Intercept
+
+	dump, err := dumpRequest(req)
+	if err != nil {
+		log.Printf("Intercept: failed to dump request %d: %v\n", reqID, err)
+		return req, nil, InterceptActionForward
+	}
+	raw, encoding := encodeBody(dump)
+
+	parse := func(raw []byte) (*http.Request, error) {
+		data, err := decodeBody(string(raw), encoding)
+		if err != nil {
+			return nil, fmt.Errorf("invalid edited request: %w", err)
+		}
+		return parseRawRequest(data, req)
+	}
+	validate := func(raw []byte) error {
+		_, err := parse(raw)
+		return err
+	}
+
+	decision := ps.intercept.hold(models.InterceptedItem{
+		RequestID: int(reqID),
+		Type:      "request",
+		Host:      req.Host,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Raw:       raw,
+		Encoding:  encoding,
+	}, validate, interceptTimeout(cfg), cfg.TimeoutAction, req.Context().Done())
+
+	action := decision.action
+	if decision.expired {
+		action = InterceptActionTimeout
+	}
+
+	if decision.action == InterceptActionDrop {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Request dropped by Kanti"), action
+	}
+
+	// Edits were validated when they were made, but the original must never
+	// go out in place of one
+	if decision.raw != nil {
+		edited, err := parse(decision.raw)
+		if err != nil {
+			log.Printf("Intercept: %v, dropping request %d\n", err, reqID)
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Edited request could not be parsed"), InterceptActionDrop
+		}
+		return edited, nil, action
+	}
+
+	return req, nil, action
+}
+
+// interceptResponse holds a response in the queue and applies the decision
+func (ps *ProxyServer) interceptResponse(resp *http.Response, req *http.Request, reqID int64) *http.Response {
+	cfg := ps.GetConfig().Intercept
+
+	dump, err := dumpResponse(resp)
+	if err != nil {
+		log.Printf("Intercept: failed to dump response %d: %v\n", reqID, err)
+		return resp
+	}
+	raw, encoding := encodeBody(dump)
+
+	parse := func(raw []byte) (*http.Response, error) {
+		data, err := decodeBody(string(raw), encoding)
+		if err != nil {
+			return nil, fmt.Errorf("invalid edited response: %w", err)
+		}
+		return parseRawResponse(data, resp)
+	}
+	validate := func(raw []byte) error {
+		_, err := parse(raw)
+		return err
+	}
+
+	decision := ps.intercept.hold(models.InterceptedItem{
+		RequestID: int(reqID),
+		Type:      "response",
+		Host:      req.Host,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Status:    resp.StatusCode,
+		Raw:       raw,
+		Encoding:  encoding,
+	}, validate, interceptTimeout(cfg), cfg.TimeoutAction, req.Context().Done())
+
+	if decision.action == InterceptActionDrop {
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Response dropped by Kanti")
+	}
+
+	if decision.raw != nil {
+		edited, err := parse(decision.raw)
+		if err != nil {
+			log.Printf("Intercept: %v, dropping response %d\n", err, reqID)
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Edited response could not be parsed")
+		}
+		return edited
+	}
+
+	return resp
+}
+
+// GetInterceptQueue returns the items currently held for review
+func (ps *ProxyServer) GetInterceptQueue() []models.InterceptedItem {
+	return ps.intercept.list()
+}
+
+// ForwardIntercepted releases a held item, optionally replacing it with edited raw text
+func (ps *ProxyServer) ForwardIntercepted(id int64, raw string) error {
+	var edited []byte
+	if raw != "" {
+		edited = []byte(raw)
+	}
+	return ps.intercept.resolve(id, InterceptActionForward, edited)
+}
+
+// DropIntercepted discards a held item
+func (ps *ProxyServer) DropIntercepted(id int64) error {
+	return ps.intercept.resolve(id, InterceptActionDrop, nil)
+}
+
+// EditIntercepted replaces the raw text of a held item without releasing it
+func (ps *ProxyServer) EditIntercepted(id int64, raw string) error {
+	return ps.intercept.edit(id, []byte(raw))
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// TestInterceptedRequestHistory checks that held requests are recorded while
+// they wait and that the record is updated with how they were resolved
+func TestInterceptedRequestHistory(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		resolve    func(ps *ProxyServer, id int64, raw string) error
+		wantAction string
+		wantStatus int
+		wantPath   string
+	}{
+		{
+			name: "forward edited",
+			resolve: func(ps *ProxyServer, id int64, raw string) error {
+				return ps.ForwardIntercepted(id, strings.Replace(raw, "/held", "/edited", 1))
+			},
+			wantAction: InterceptActionForward,
+			wantStatus: http.StatusOK,
+			wantPath:   "/edited",
+		},
+		{
+			name: "drop",
+			resolve: func(ps *ProxyServer, id int64, raw string) error {
+				return ps.DropIntercepted(id)
+			},
+			wantAction: InterceptActionDrop,
+			wantStatus: http.StatusBadGateway,
+			wantPath:   "/held",
+		},
+		{
+			name: "bad edit",
+			resolve: func(ps *ProxyServer, id int64, raw string) error {
+				// Unparseable edits are rejected and the request stays held
+				if err := ps.ForwardIntercepted(id, "not a request"); err == nil || errors.Is(err, ErrInterceptNotFound) {
+					return fmt.Errorf("bad forward edit not rejected: %v", err)
+				}
+				if err := ps.EditIntercepted(id, "not a request"); err == nil || errors.Is(err, ErrInterceptNotFound) {
+					return fmt.Errorf("bad edit not rejected: %v", err)
+				}
+				if queue := ps.GetInterceptQueue(); len(queue) != 1 || queue[0].Edited {
+					return fmt.Errorf("bad edit changed the queue: %+v", queue)
+				}
+				return ps.ForwardIntercepted(id, "")
+			},
+			wantAction: InterceptActionForward,
+			wantStatus: http.StatusOK,
+			wantPath:   "/held",
+		},
+		{
+			name:       "timeout",
+			wantAction: InterceptActionTimeout,
+			wantStatus: http.StatusBadGateway,
+			wantPath:   "/held",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := NewProxyServer(t.TempDir(), &models.ProxyConfig{
+				Intercept: models.InterceptConfig{
+					Enabled:        true,
+					TimeoutSeconds: 1,
+					TimeoutAction:  InterceptActionDrop,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxy := httptest.NewServer(ps.proxy)
+			defer proxy.Close()
+			proxyURL, _ := url.Parse(proxy.URL)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+			status := make(chan int, 1)
+			go func() {
+				resp, err := client.Get(upstream.URL + "/held")
+				if err != nil {
+					t.Error(err)
+					status <- 0
+					return
+				}
+				resp.Body.Close()
+				status <- resp.StatusCode
+			}()
+
+			// The request is listed while it is held
+			var item models.InterceptedItem
+			for deadline := time.Now().Add(time.Second); ; {
+				if queue := ps.GetInterceptQueue(); len(queue) > 0 {
+					item = queue[0]
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("request was not held")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			records := ps.GetRequests()
+			if len(records) != 1 || records[0].ID != item.RequestID || records[0].InterceptAction != "" {
+				t.Fatalf("held request not recorded as pending: %+v", records)
+			}
+
+			if tt.resolve != nil {
+				if err := tt.resolve(ps, item.ID, item.Raw); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := <-status; got != tt.wantStatus {
+				t.Errorf("status = %d, want %d", got, tt.wantStatus)
+			}
+
+			record := ps.GetRequests()[0]
+			if record.InterceptAction != tt.wantAction {
+				t.Errorf("InterceptAction = %q, want %q", record.InterceptAction, tt.wantAction)
+			}
+			if record.Path != tt.wantPath {
+				t.Errorf("Path = %q, want %q", record.Path, tt.wantPath)
+			}
+			if record.Status != tt.wantStatus {
+				t.Errorf("recorded status = %d, want %d", record.Status, tt.wantStatus)
+			}
+			if tt.wantAction == InterceptActionTimeout && record.HeldTime < 1000 {
+				t.Errorf("HeldTime = %dms, want the 1s timeout", record.HeldTime)
+			}
+		})
+	}
+}
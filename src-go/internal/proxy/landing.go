@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+	"github.com/elazarl/goproxy"
+)
+
+// LandingHost is the host the proxy serves its landing page on, e.g. http://kanti/
+const LandingHost = "kanti"
+
+// landingTemplate renders the landing page from the CA in use
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Kanti</title>
+<style>
+body { font-family: -apple-system, system-ui, sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+code { font-size: 0.85em; word-break: break-all; }
+dt { font-weight: bold; margin-top: 0.8em; }
+</style>
+</head>
+<body>
+<h1>Kanti</h1>
+<p>Install the Kanti CA certificate to intercept HTTPS traffic from this device.</p>
+<ul>
+<li><a href="/cert">CA certificate (DER)</a> for Android, Windows and iOS</li>
+<li><a href="/cert.pem">CA certificate (PEM)</a> for Firefox, Linux and macOS</li>
+</ul>
+<dl>
+<dt>Subject</dt><dd>{{.Subject}}</dd>
+<dt>SHA-256</dt><dd><code>{{.SHA256}}</code></dd>
+<dt>SHA-1</dt><dd><code>{{.SHA1}}</code></dd>
+<dt>Expires</dt><dd>{{.NotAfter.Format "2006-01-02"}}{{if .Expired}} (expired){{end}}</dd>
+</dl>
+</body>
+</html>
+`))
+
+// setupLandingPage serves the landing page to requests for LandingHost and to
+// clients that open the listener directly, before they reach the capture handlers
+func (ps *ProxyServer) setupLandingPage() {
+	isLanding := goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return strings.EqualFold(stripPort(req.URL.Host), LandingHost)
+	})
+	ps.proxy.OnRequest(isLanding).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, ps.landingResponse(req)
+	})
+
+	ps.proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resp := ps.landingResponse(req)
+		defer resp.Body.Close()
+
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	})
+}
+
+// landingResponse answers a request to the landing page
+func (ps *ProxyServer) landingResponse(req *http.Request) *http.Response {
+	var format, contentType, filename string
+	switch req.URL.Path {
+	case "/", "":
+		var page bytes.Buffer
+		if err := landingTemplate.Execute(&page, ps.GetCAInfo()); err != nil {
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+		}
+		return goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusOK, page.String())
+
+	case "/cert", "/cert.cer", "/cert.der":
+		format, contentType, filename = models.CAFormatDER, "application/x-x509-ca-cert", "kanti-ca.cer"
+
+	case "/cert.pem", "/cert.crt":
+		format, contentType, filename = models.CAFormatPEM, "application/x-pem-file", "kanti-ca.pem"
+
+	default:
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNotFound, "Not found")
+	}
+
+	data, err := ps.ExportCA(format, "", false)
+	if err != nil {
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+	}
+
+	resp := goproxy.NewResponse(req, contentType, http.StatusOK, string(data))
+	resp.Header.Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	return resp
+}
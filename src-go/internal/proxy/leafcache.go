@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// DefaultLeafCacheSize is the number of leaf certificates kept in memory
+// unless configured otherwise
+const DefaultLeafCacheSize = 1000
+
+// LeafRenewBefore is how long before expiry a leaf certificate is replaced
+const LeafRenewBefore = 30 * 24 * time.Hour
+
+// leafCache is a least recently used cache of leaf certificates by cache key
+type leafCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Most recently used first
+	entries map[string]*list.Element
+}
+
+// leafEntry is an element of leafCache.order
+type leafEntry struct {
+	key  string
+	cert *tls.Certificate
+}
+
+// newLeafCache creates a cache holding up to size certificates
+func newLeafCache(size int) *leafCache {
+	return &leafCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the certificate for key unless it is close to expiry, marking it used
+func (c *leafCache) get(key string, now time.Time) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*leafEntry)
+	if !usableLeaf(entry.cert, now) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	return entry.cert, true
+}
+
+// add stores the certificate for key, evicting the least recently used ones
+func (c *leafCache) add(key string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*leafEntry).cert = cert
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&leafEntry{key: key, cert: cert})
+	c.evict()
+}
+
+// remove drops the certificate for key
+func (c *leafCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// clear drops every certificate
+func (c *leafCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	clear(c.entries)
+}
+
+// resize changes the capacity, evicting certificates that no longer fit
+func (c *leafCache) resize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = size
+	c.evict()
+}
+
+// evict drops the least recently used certificates beyond the capacity.
+// Caller must hold c.mu.
+func (c *leafCache) evict() {
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*leafEntry).key)
+	}
+}
+
+// usableLeaf checks that a leaf certificate is not close to expiry
+func usableLeaf(cert *tls.Certificate, now time.Time) bool {
+	return cert.Leaf != nil && now.Add(LeafRenewBefore).Before(cert.Leaf.NotAfter)
+}
+
+// SetLeafCache sizes the in-memory leaf cache (0 = DefaultLeafCacheSize) and
+// turns persisting leaf certificates to disk on or off
+func (cm *CertificateManager) SetLeafCache(size int, persist bool) {
+	if size <= 0 {
+		size = DefaultLeafCacheSize
+	}
+	cm.certs.resize(size)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.persistLeaves = persist
+}
+
+// leafFile returns the file a leaf certificate is persisted in
+func (cm *CertificateManager) leafFile(cacheKey string) string {
+	sum := sha256.Sum256([]byte(cacheKey))
+	return filepath.Join(cm.leafDir, hex.EncodeToString(sum[:16])+".pem")
+}
+
+// loadLeaf reads a persisted leaf certificate, if it was issued by caCert with
+// a keyType key, covers names and is not close to expiry. Leaves may carry more
+// names, such as upstream SANs learned before a restart.
+func (cm *CertificateManager) loadLeaf(cacheKey string, names []string, caCert *x509.Certificate, keyType string) (*tls.Certificate, bool) {
+	data, err := os.ReadFile(cm.leafFile(cacheKey))
+	if err != nil {
+		return nil, false
+	}
+
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil || cert.Leaf == nil || len(cert.Certificate) < 2 {
+		return nil, false
+	}
+
+	if !bytes.Equal(cert.Certificate[1], caCert.Raw) || !usableLeaf(&cert, time.Now()) {
+		return nil, false
+	}
+
+	if !leafCovers(cert.Leaf, names) {
+		return nil, false
+	}
+
+	switch cert.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		if keyType != models.LeafKeyECDSA {
+			return nil, false
+		}
+	case *rsa.PrivateKey:
+		if keyType == models.LeafKeyECDSA {
+			return nil, false
+		}
+	}
+
+	return &cert, true
+}
+
+// saveLeaf persists a leaf certificate and its key in one PEM file
+func (cm *CertificateManager) saveLeaf(cacheKey string, cert *tls.Certificate) error {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode leaf key: %w", err)
+	}
+
+	var data bytes.Buffer
+	for _, der := range cert.Certificate {
+		pem.Encode(&data, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	pem.Encode(&data, &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+
+	if err := os.MkdirAll(cm.leafDir, 0700); err != nil {
+		return fmt.Errorf("failed to create leaf certificate directory: %w", err)
+	}
+	return writeFileAtomic(cm.leafFile(cacheKey), data.Bytes(), 0600)
+}
+
+// removeLeaves deletes every persisted leaf certificate
+func (cm *CertificateManager) removeLeaves() error {
+	return os.RemoveAll(cm.leafDir)
+}
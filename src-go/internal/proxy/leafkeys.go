@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// KeyPoolSize is the number of RSA leaf keys generated ahead of time
+const KeyPoolSize = 16
+
+// keyPool generates RSA leaf keys in the background, so a burst of new hosts
+// does not wait for key generation. It starts filling on first use.
+type keyPool struct {
+	once sync.Once
+	keys chan *rsa.PrivateKey
+}
+
+// get returns a pre-generated key, or generates one if the pool ran dry
+func (p *keyPool) get() (*rsa.PrivateKey, error) {
+	p.once.Do(func() {
+		p.keys = make(chan *rsa.PrivateKey, KeyPoolSize)
+		go p.fill()
+	})
+
+	select {
+	case key := <-p.keys:
+		return key, nil
+	default:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+}
+
+// fill keeps the pool topped up
+func (p *keyPool) fill() {
+	for {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			log.Printf("Key pool: failed to generate RSA key: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		p.keys <- key
+	}
+}
+
+// leafKey returns a fresh private key of the given LeafKey* type
+func (cm *CertificateManager) leafKey(keyType string) (crypto.Signer, error) {
+	if keyType == models.LeafKeyECDSA {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return cm.rsaKeys.get()
+}
+
+// SetLeafKeyType selects the LeafKey* type of new leaf certificates. Cached
+// leaves of the previous type are dropped.
+func (cm *CertificateManager) SetLeafKeyType(keyType string) {
+	if keyType != models.LeafKeyECDSA {
+		keyType = models.LeafKeyRSA
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.leafKeyType != keyType {
+		cm.leafKeyType = keyType
+		cm.certs.clear()
+	}
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+	"github.com/elazarl/goproxy"
+)
+
+// listenerContextKey stores the listener config on requests served by a listener
+type listenerContextKey struct{}
+
+// proxyListener is a running listener
+type proxyListener struct {
+	config   models.ListenerConfig
+	listener net.Listener
+}
+
+// listenerConfigs returns the default listener followed by the configured ones
+func (ps *ProxyServer) listenerConfigs() []models.ListenerConfig {
+	config := ps.GetConfig()
+
+	configs := []models.ListenerConfig{{
+		ID:              models.DefaultListenerID,
+		Port:            config.Port,
+		Mode:            models.ListenerRegular,
+		SSLInterception: config.SSLInterception,
+		AutoStart:       true,
+	}}
+
+	return append(configs, config.Listeners...)
+}
+
+// validateListeners checks that every configured listener has its own ID and
+// that none claims the ID of the implicit default listener
+func validateListeners(listeners []models.ListenerConfig) error {
+	seen := make(map[string]bool, len(listeners))
+	for _, lc := range listeners {
+		switch {
+		case lc.ID == "":
+			return fmt.Errorf("listener on port %d has no ID", lc.Port)
+		case lc.ID == models.DefaultListenerID:
+			return fmt.Errorf("listener ID %q is reserved for the listener on the proxy port", lc.ID)
+		case seen[lc.ID]:
+			return fmt.Errorf("duplicate listener ID %q", lc.ID)
+		}
+		seen[lc.ID] = true
+	}
+	return nil
+}
+
+// findListenerConfig looks up a listener config by ID
+func (ps *ProxyServer) findListenerConfig(id string) (models.ListenerConfig, bool) {
+	for _, lc := range ps.listenerConfigs() {
+		if lc.ID == id {
+			return lc, true
+		}
+	}
+	return models.ListenerConfig{}, false
+}
+
+// startListener opens and serves a listener. Caller must hold ps.mu.
+func (ps *ProxyServer) startListener(lc models.ListenerConfig) error {
+	if _, ok := ps.listeners[lc.ID]; ok {
+		return fmt.Errorf("listener %s already running", lc.ID)
+	}
+
+	addr := net.JoinHostPort(lc.BindAddress, strconv.Itoa(lc.Port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start listener %s: %w", lc.ID, err)
+	}
+
+	switch lc.Mode {
+	case models.ListenerRegular, "":
+		server := &http.Server{
+			Handler: flushStreams(ps.proxy),
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, listenerContextKey{}, lc)
+			},
+		}
+		go func() {
+			if err := server.Serve(listener); err != nil && ps.IsListenerRunning(lc.ID) {
+				log.Printf("Listener %s error: %v\n", lc.ID, err)
+			}
+		}()
+
+	case models.ListenerSOCKS:
+		go acceptConns(listener, "SOCKS", func(conn net.Conn) {
+			ps.serveSOCKS(conn, lc)
+		})
+
+	case models.ListenerInvisible:
+		go acceptConns(listener, "Invisible proxy", func(conn net.Conn) {
+			ps.serveConn(conn, "", lc)
+		})
+
+	default:
+		listener.Close()
+		return fmt.Errorf("unknown listener mode %q", lc.Mode)
+	}
+
+	ps.listeners[lc.ID] = &proxyListener{config: lc, listener: listener}
+	log.Printf("Listener %s (%s) listening on %s\n", lc.ID, lc.Mode, addr)
+
+	return nil
+}
+
+// stopListener closes a running listener. Caller must hold ps.mu.
+func (ps *ProxyServer) stopListener(id string) error {
+	pl, ok := ps.listeners[id]
+	if !ok {
+		return fmt.Errorf("listener %s not running", id)
+	}
+
+	delete(ps.listeners, id)
+	if err := pl.listener.Close(); err != nil {
+		return fmt.Errorf("failed to stop listener %s: %w", id, err)
+	}
+
+	log.Printf("Listener %s stopped\n", id)
+	return nil
+}
+
+// StartListener starts a single configured listener
+func (ps *ProxyServer) StartListener(id string) error {
+	lc, ok := ps.findListenerConfig(id)
+	if !ok {
+		return fmt.Errorf("listener %s not found", id)
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.startListener(lc)
+}
+
+// StopListener stops a single running listener
+func (ps *ProxyServer) StopListener(id string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.stopListener(id)
+}
+
+// IsListenerRunning returns whether the listener with the given ID is running
+func (ps *ProxyServer) IsListenerRunning(id string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	_, ok := ps.listeners[id]
+	return ok
+}
+
+// GetListeners returns the status of every configured listener
+func (ps *ProxyServer) GetListeners() []models.ListenerStatus {
+	configs := ps.listenerConfigs()
+
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return ps.listenerStatuses(configs)
+}
+
+// listenerStatuses reports the configured listeners. Caller must hold ps.mu.
+func (ps *ProxyServer) listenerStatuses(configs []models.ListenerConfig) []models.ListenerStatus {
+	statuses := make([]models.ListenerStatus, 0, len(configs))
+	for _, lc := range configs {
+		status := models.ListenerStatus{ListenerConfig: lc}
+		if pl, ok := ps.listeners[lc.ID]; ok {
+			// Report the settings the listener was started with
+			status.ListenerConfig = pl.config
+			status.IsRunning = true
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// listenerFor returns the config of the listener a request came through
+func listenerFor(req *http.Request) (models.ListenerConfig, bool) {
+	lc, ok := req.Context().Value(listenerContextKey{}).(models.ListenerConfig)
+	return lc, ok
+}
+
+// handleConnect decides whether a CONNECT tunnel is MITM'd based on its listener
+func (ps *ProxyServer) handleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	lc, ok := listenerFor(ctx.Req)
+	if !ok {
+		lc = models.ListenerConfig{ID: models.DefaultListenerID, SSLInterception: ps.GetConfig().SSLInterception}
+	}
+
+	if !lc.SSLInterception {
+		return goproxy.OkConnect, host
+	}
+
+	// MITM through the same pipeline as SOCKS and invisible connections,
+	// which negotiates HTTP/2 with the client when offered
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			if _, err := client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n")); err != nil {
+				client.Close()
+				return
+			}
+			ps.serveConn(client, host, lc)
+		},
+	}, host
+}
@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// compiledRules caches compiled match-and-replace and scope regexes by
+// pattern. It is cleared on every config update, so it only holds the
+// patterns of the current config.
+var compiledRules sync.Map
+
+// compileRule returns the compiled regex for a rule pattern
+func compileRule(pattern string) (*regexp.Regexp, error) {
+	if re, ok := compiledRules.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compiledRules.Store(pattern, re)
+
+	return re, nil
+}
+
+// ruleName returns the identifier recorded when a rule fires
+func ruleName(rule models.MatchReplaceRule, index int) string {
+	if rule.ID != "" {
+		return rule.ID
+	}
+	return fmt.Sprintf("#%d", index)
+}
+
+// replaceText applies a rule to a piece of text and reports whether it changed
+func replaceText(rule models.MatchReplaceRule, text string) (string, bool) {
+	if rule.Match == "" {
+		return text, false
+	}
+
+	var result string
+	if rule.Regex {
+		re, err := compileRule(rule.Match)
+		if err != nil {
+			log.Printf("Match/replace: invalid regex %q: %v\n", rule.Match, err)
+			return text, false
+		}
+		result = re.ReplaceAllString(text, rule.Replace)
+	} else {
+		result = strings.ReplaceAll(text, rule.Match, rule.Replace)
+	}
+
+	return result, result != text
+}
+
+// activeRules returns the enabled rules for a target that apply to host
+func activeRules(rules []models.MatchReplaceRule, host string, targets ...string) []int {
+	var indexes []int
+	for i, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+
+		targeted := false
+		for _, t := range targets {
+			if rule.Target == t {
+				targeted = true
+				break
+			}
+		}
+		if !targeted {
+			continue
+		}
+
+		if len(rule.Hosts) > 0 {
+			matched := false
+			for _, pattern := range rule.Hosts {
+				if matchesPattern(host, pattern) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// applyRequestRules rewrites a request and returns the rules that fired
+func (ps *ProxyServer) applyRequestRules(req *http.Request) []string {
+	rules := ps.GetConfig().MatchReplace
+	var applied []string
+
+	for _, i := range activeRules(rules, req.Host, models.TargetRequestLine, models.TargetRequestHeader, models.TargetRequestBody) {
+		rule := rules[i]
+
+		var fired bool
+		switch rule.Target {
+		case models.TargetRequestLine:
+			fired = replaceRequestLine(rule, req)
+		case models.TargetRequestHeader:
+			var host string
+			host, fired = replaceHeaders(rule, req.Header, req.Host)
+			req.Host = host
+		case models.TargetRequestBody:
+			fired = replaceBody(rule, req.Header, &req.Body, &req.ContentLength)
+		}
+
+		if fired {
+			applied = append(applied, ruleName(rule, i))
+		}
+	}
+
+	return applied
+}
+
+// applyResponseRules rewrites a response and returns the rules that fired
+func (ps *ProxyServer) applyResponseRules(resp *http.Response, host string) []string {
+	rules := ps.GetConfig().MatchReplace
+	var applied []string
+
+	for _, i := range activeRules(rules, host, models.TargetResponseStatus, models.TargetResponseHeader, models.TargetResponseBody) {
+		rule := rules[i]
+
+		var fired bool
+		switch rule.Target {
+		case models.TargetResponseStatus:
+			fired = replaceStatusLine(rule, resp)
+		case models.TargetResponseHeader:
+			_, fired = replaceHeaders(rule, resp.Header, "")
+		case models.TargetResponseBody:
+			// The body of an upgrade response is the upgraded connection itself,
+			// and streams never finish buffering
+			if resp.StatusCode != http.StatusSwitchingProtocols && !isStreamingResponse(resp) {
+				fired = replaceResponseBody(rule, resp)
+			}
+		}
+
+		if fired {
+			applied = append(applied, ruleName(rule, i))
+		}
+	}
+
+	return applied
+}
+
+// replaceRequestLine applies a rule to "METHOD /path?query HTTP/1.1"
+func replaceRequestLine(rule models.MatchReplaceRule, req *http.Request) bool {
+	line := fmt.Sprintf("%s %s HTTP/1.1", req.Method, req.URL.RequestURI())
+	result, changed := replaceText(rule, line)
+	if !changed {
+		return false
+	}
+
+	parts := strings.Fields(result)
+	if len(parts) < 2 {
+		log.Printf("Match/replace: rule produced invalid request line %q\n", result)
+		return false
+	}
+
+	target, err := url.ParseRequestURI(parts[1])
+	if err != nil {
+		log.Printf("Match/replace: rule produced invalid request target %q: %v\n", parts[1], err)
+		return false
+	}
+
+	req.Method = parts[0]
+	req.URL.Path = target.Path
+	req.URL.RawPath = target.RawPath
+	req.URL.RawQuery = target.RawQuery
+
+	return true
+}
+
+// replaceStatusLine applies a rule to "HTTP/1.1 200 OK"
+func replaceStatusLine(rule models.MatchReplaceRule, resp *http.Response) bool {
+	text := strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" ")
+	if text == "" {
+		text = http.StatusText(resp.StatusCode)
+	}
+
+	line := fmt.Sprintf("HTTP/1.1 %d %s", resp.StatusCode, text)
+	result, changed := replaceText(rule, line)
+	if !changed {
+		return false
+	}
+
+	parts := strings.SplitN(result, " ", 3)
+	if len(parts) < 2 {
+		log.Printf("Match/replace: rule produced invalid status line %q\n", result)
+		return false
+	}
+
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 100 || code > 999 {
+		log.Printf("Match/replace: rule produced invalid status code %q\n", parts[1])
+		return false
+	}
+
+	resp.StatusCode = code
+	resp.Status = strings.Join(parts[1:], " ")
+
+	return true
+}
+
+// replaceHeaders applies a rule to each "Name: value" header line. An empty
+// match adds the replacement as a new header and a line rewritten to nothing
+// removes the header. A non-empty host is included as a Host line and the
+// possibly rewritten value is returned.
+func replaceHeaders(rule models.MatchReplaceRule, header http.Header, host string) (string, bool) {
+	if rule.Match == "" {
+		name, value, ok := parseHeaderLine(rule.Replace)
+		if !ok {
+			return host, false
+		}
+		if strings.EqualFold(name, "Host") && host != "" {
+			return value, true
+		}
+		header.Add(name, value)
+		return host, true
+	}
+
+	lines := headerLines(header)
+	if host != "" {
+		lines = append([]string{"Host: " + host}, lines...)
+	}
+
+	changed := false
+	for i, line := range lines {
+		if result, ok := replaceText(rule, line); ok {
+			lines[i] = result
+			changed = true
+		}
+	}
+
+	if !changed {
+		return host, false
+	}
+
+	for name := range header {
+		delete(header, name)
+	}
+
+	for _, line := range lines {
+		name, value, ok := parseHeaderLine(line)
+		if !ok {
+			continue
+		}
+		if strings.EqualFold(name, "Host") && host != "" {
+			host = value
+			continue
+		}
+		header.Add(name, value)
+	}
+
+	return host, true
+}
+
+// headerLines flattens a header into sorted "Name: value" lines
+func headerLines(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		for _, value := range header[name] {
+			lines = append(lines, name+": "+value)
+		}
+	}
+	return lines
+}
+
+// parseHeaderLine splits a "Name: value" line
+func parseHeaderLine(line string) (string, string, bool) {
+	name, value, ok := strings.Cut(line, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(value), true
+}
+
+// replaceBody applies a rule to a buffered body and fixes up Content-Length
+func replaceBody(rule models.MatchReplaceRule, header http.Header, body *io.ReadCloser, contentLength *int64) bool {
+	data, err := readAndRestoreBody(body)
+	if err != nil || data == nil {
+		return false
+	}
+
+	result, changed := replaceText(rule, string(data))
+	if !changed {
+		return false
+	}
+
+	setRawBody(header, body, contentLength, []byte(result))
+	return true
+}
+
+// replaceResponseBody applies a rule to the decoded response body. A changed
+// body is sent to the client without its original content encoding.
+func replaceResponseBody(rule models.MatchReplaceRule, resp *http.Response) bool {
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding == "" {
+		return replaceBody(rule, resp.Header, &resp.Body, &resp.ContentLength)
+	}
+
+	data, err := readAndRestoreBody(&resp.Body)
+	if err != nil || data == nil {
+		return false
+	}
+
+	decoded, err := decompressResponse(data, encoding)
+	if err != nil {
+		return false
+	}
+
+	result, changed := replaceText(rule, string(decoded))
+	if !changed {
+		return false
+	}
+
+	resp.Header.Del("Content-Encoding")
+	setRawBody(resp.Header, &resp.Body, &resp.ContentLength, []byte(result))
+
+	return true
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// PassthroughAfterRejections is how many handshakes in a row a client must
+// reject the Kanti certificate in before its host is learned
+const PassthroughAfterRejections = 2
+
+// certificateAlerts are the TLS alerts clients send when they reject a certificate
+var certificateAlerts = []tls.AlertError{
+	42, // bad_certificate
+	43, // unsupported_certificate
+	44, // certificate_revoked
+	45, // certificate_expired
+	46, // certificate_unknown
+	48, // unknown_ca
+}
+
+// passthroughList holds the hosts learned to reject the Kanti certificate
+type passthroughList struct {
+	mu         sync.RWMutex
+	hosts      map[string]models.PassthroughHost
+	rejections map[string]int // Certificate rejections in a row by host not yet learned
+}
+
+// shouldPassthrough checks whether TLS to host (host or host:port) is tunneled
+// without decryption
+func (ps *ProxyServer) shouldPassthrough(host string) bool {
+	config := ps.GetConfig().TLSPassthrough
+
+	for _, pattern := range config.Hosts {
+		if matchesPattern(host, pattern) {
+			return true
+		}
+	}
+
+	ps.passthrough.mu.RLock()
+	_, learned := ps.passthrough.hosts[strings.ToLower(stripPort(host))]
+	ps.passthrough.mu.RUnlock()
+	if learned {
+		return true
+	}
+
+	return config.OutOfScope && !ps.hostMayBeInScope(&url.URL{Scheme: "https", Host: host})
+}
+
+// passthroughTarget names the destination of a TLS connection for the
+// passthrough decision, preferring the SNI over the CONNECT target. Invisible
+// connections without SNI cannot be tunneled and return "".
+func passthroughTarget(target string, hello *models.ClientHello) string {
+	if hello == nil || hello.ServerName == "" {
+		return target
+	}
+
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		// Invisible clients dialed the proxy in place of the server, like
+		// their Host headers assume the default port
+		port = "443"
+	}
+	return net.JoinHostPort(hello.ServerName, port)
+}
+
+// certificateRejected checks whether a failed client handshake ended with an
+// alert rejecting our certificate, rather than the client going away
+func certificateRejected(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+
+	// crypto/tls reports received alerts with an unexported type that
+	// prints like AlertError
+	for _, alert := range certificateAlerts {
+		if opErr.Err.Error() == alert.Error() {
+			return true
+		}
+	}
+	return false
+}
+
+// alertRecorder remembers the last bytes a client sent during the handshake.
+// OpenSSL based clients send the alert rejecting a TLS 1.3 certificate in
+// plaintext, which crypto/tls fails to decrypt instead of reporting it.
+type alertRecorder struct {
+	net.Conn
+	tail      [7]byte // Room for one alert record
+	n         int
+	handshake bool
+}
+
+// newAlertRecorder wraps conn, recording until the handshake completes
+func newAlertRecorder(conn net.Conn) *alertRecorder {
+	return &alertRecorder{Conn: conn, handshake: true}
+}
+
+func (r *alertRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if r.handshake {
+		for _, b := range p[:n] {
+			copy(r.tail[:], r.tail[1:])
+			r.tail[len(r.tail)-1] = b
+		}
+		r.n += n
+	}
+	return n, err
+}
+
+// handshakeDone stops recording
+func (r *alertRecorder) handshakeDone() {
+	r.handshake = false
+}
+
+// handshakeError replaces err with the alert ending the client's stream, if
+// that alert was sent in plaintext
+func (r *alertRecorder) handshakeError(err error) error {
+	t := r.tail
+	// Alert record: content type 21, TLS 1.x, length 2, level, description
+	if r.n < len(t) || t[0] != 21 || t[1] != 3 || t[3] != 0 || t[4] != 2 {
+		return err
+	}
+	return &net.OpError{Op: "remote error", Err: tls.AlertError(t[6])}
+}
+
+// learnPassthrough adds a host whose client rejected our certificate
+// PassthroughAfterRejections times in a row, if enabled. It reports whether the
+// host was added.
+func (ps *ProxyServer) learnPassthrough(host string, err error) bool {
+	if !ps.GetConfig().TLSPassthrough.AutoAdd || !certificateRejected(err) {
+		return false
+	}
+
+	host = strings.ToLower(stripPort(host))
+	if host == "" {
+		return false
+	}
+
+	ps.passthrough.mu.Lock()
+	defer ps.passthrough.mu.Unlock()
+
+	if ps.passthrough.hosts == nil {
+		ps.passthrough.hosts = make(map[string]models.PassthroughHost)
+	}
+	if _, ok := ps.passthrough.hosts[host]; ok {
+		return false
+	}
+
+	if ps.passthrough.rejections == nil {
+		ps.passthrough.rejections = make(map[string]int)
+	}
+	ps.passthrough.rejections[host]++
+	if ps.passthrough.rejections[host] < PassthroughAfterRejections {
+		return false
+	}
+	delete(ps.passthrough.rejections, host)
+
+	ps.passthrough.hosts[host] = models.PassthroughHost{
+		Host:    host,
+		AddedAt: time.Now(),
+		Error:   err.Error(),
+	}
+	log.Printf("Added %s to TLS passthrough after a failed client handshake\n", host)
+	return true
+}
+
+// acceptedCertificate resets the rejections counted for a host whose client
+// completed a handshake
+func (ps *ProxyServer) acceptedCertificate(host string) {
+	host = strings.ToLower(stripPort(host))
+
+	ps.passthrough.mu.Lock()
+	defer ps.passthrough.mu.Unlock()
+
+	delete(ps.passthrough.rejections, host)
+}
+
+// GetPassthroughHosts returns the learned passthrough hosts, sorted by host
+func (ps *ProxyServer) GetPassthroughHosts() []models.PassthroughHost {
+	ps.passthrough.mu.RLock()
+	defer ps.passthrough.mu.RUnlock()
+
+	hosts := make([]models.PassthroughHost, 0, len(ps.passthrough.hosts))
+	for _, h := range ps.passthrough.hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+// RemovePassthroughHost forgets a learned passthrough host, or all of them if host is empty
+func (ps *ProxyServer) RemovePassthroughHost(host string) {
+	ps.passthrough.mu.Lock()
+	defer ps.passthrough.mu.Unlock()
+
+	if host == "" {
+		ps.passthrough.hosts = nil
+		ps.passthrough.rejections = nil
+		return
+	}
+	delete(ps.passthrough.hosts, strings.ToLower(host))
+}
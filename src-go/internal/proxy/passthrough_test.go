@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// clientHandshakeError runs a handshake against a leaf from cm with client
+// and returns the error the server side saw
+func clientHandshakeError(t *testing.T, cm *CertificateManager, client func(net.Conn)) error {
+	t.Helper()
+
+	cert, err := cm.GenerateServerCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		defer clientConn.Close()
+		client(clientConn)
+	}()
+
+	recorder := newAlertRecorder(serverConn)
+	err = tls.Server(recorder, &tls.Config{Certificates: []tls.Certificate{*cert}}).Handshake()
+	if err != nil {
+		err = recorder.handshakeError(err)
+	}
+	return err
+}
+
+func TestCertificateRejected(t *testing.T) {
+	cm := newTestCertificateManager(t, t.TempDir())
+
+	tests := []struct {
+		name   string
+		client func(net.Conn)
+		want   bool
+	}{
+		{
+			name: "untrusted CA",
+			client: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+			},
+			want: true,
+		},
+		{
+			name: "plaintext alert",
+			client: func(conn net.Conn) {
+				// Reject the certificate like OpenSSL, before installing the handshake keys
+				tls.Client(conn, &tls.Config{
+					InsecureSkipVerify: true,
+					VerifyConnection: func(tls.ConnectionState) error {
+						conn.Write([]byte{21, 3, 3, 0, 2, 2, 48})
+						conn.Close()
+						return errors.New("unknown CA")
+					},
+				}).Handshake()
+			},
+			want: true,
+		},
+		{
+			name: "hang up",
+			client: func(conn net.Conn) {
+				// Send a ClientHello, then abort like a speculative connection
+				tc := tls.Client(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+				go tc.Handshake()
+				io.ReadFull(conn, make([]byte, 5))
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := clientHandshakeError(t, cm, tt.client)
+			if err == nil {
+				t.Fatal("handshake succeeded")
+			}
+			if got := certificateRejected(err); got != tt.want {
+				t.Errorf("certificateRejected(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+
+	for _, err := range []error{io.EOF, os.ErrDeadlineExceeded, errors.New("connection reset by peer")} {
+		if certificateRejected(err) {
+			t.Errorf("certificateRejected(%v) = true", err)
+		}
+	}
+}
+
+func TestLearnPassthrough(t *testing.T) {
+	ps, err := NewProxyServer(t.TempDir(), &models.ProxyConfig{
+		TLSPassthrough: models.TLSPassthrough{AutoAdd: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := &net.OpError{Op: "remote error", Err: tls.AlertError(48)}
+
+	if ps.learnPassthrough("a.example.com:443", io.EOF) {
+		t.Error("learned a host that hung up")
+	}
+	for i := 1; i < PassthroughAfterRejections; i++ {
+		if ps.learnPassthrough("a.example.com:443", rejected) {
+			t.Fatalf("learned after %d rejections", i)
+		}
+	}
+	if !ps.learnPassthrough("a.example.com:443", rejected) {
+		t.Fatalf("not learned after %d rejections", PassthroughAfterRejections)
+	}
+	if !ps.shouldPassthrough("a.example.com:443") {
+		t.Error("learned host is intercepted")
+	}
+
+	// A completed handshake starts the count over
+	for i := 1; i < PassthroughAfterRejections; i++ {
+		ps.learnPassthrough("b.example.com:443", rejected)
+	}
+	ps.acceptedCertificate("b.example.com:443")
+	if ps.learnPassthrough("b.example.com:443", rejected) {
+		t.Error("learned a host that accepted the certificate in between")
+	}
+}
@@ -1,21 +1,19 @@
 package proxy
 
 import (
-	"bytes"
-	"compress/gzip"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"strings"
+	"slices"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/1342tools/kanti/backend/pkg/models"
-	"github.com/andybalholm/brotli"
 	"github.com/elazarl/goproxy"
 )
 
@@ -28,10 +26,12 @@ const (
 
 // ProxyServer implements the HTTP/HTTPS proxy with SSL interception
 type ProxyServer struct {
-	proxy    *goproxy.ProxyHttpServer
-	certMgr  *CertificateManager
-	config   *models.ProxyConfig
-	listener net.Listener
+	proxy   *goproxy.ProxyHttpServer
+	certMgr *CertificateManager
+	config  *models.ProxyConfig
+
+	// Running listeners by ID
+	listeners map[string]*proxyListener
 
 	// Request tracking
 	requestID  int64
@@ -47,11 +47,37 @@ type ProxyServer struct {
 	batchMu    sync.Mutex
 	batchTimer *time.Timer
 
+	// HTTP/2-capable upstream transport for clients that negotiated h2
+	h2Transport *http.Transport
+
+	// Intercept queue
+	intercept *interceptQueue
+
+	// Captured WebSocket messages and open connections by handshake request ID
+	wsHistory  wsHistory
+	wsRelays   map[int]*wsRelay
+	wsRelaysMu sync.Mutex
+
 	// Event callbacks
 	onRequest    func(models.RequestDetails)
 	onResponse   func(models.RequestDetails)
 	onBatchFlush func([]models.RequestDetails, []models.RequestDetails)
 
+	onWebSocketMessage func(models.WebSocketMessage)
+	onResponseChunk    func(models.ResponseChunk)
+
+	onTLSHandshakeFailure func(models.TLSHandshakeFailure)
+
+	// TLS metadata of upstream connections
+	tlsInfos tlsInfoCache
+
+	// Hosts learned to reject the Kanti certificate
+	passthrough passthroughList
+
+	// Upstream transports presenting browser ClientHellos, by fingerprint profile
+	impersonators   map[string]*impersonatingTransport
+	impersonatorsMu sync.Mutex
+
 	// Server state
 	isRunning bool
 	mu        sync.RWMutex
@@ -76,6 +102,10 @@ func NewProxyServer(dataDir string, config *models.ProxyConfig) (*ProxyServer, e
 
 	// Store certificate path in config
 	config.CertPath = certMgr.GetCACertificatePath()
+	certMgr.SetWildcardMode(config.WildcardCertificates)
+	certMgr.SetCopyUpstreamSANs(config.CopyUpstreamSANs)
+	certMgr.SetLeafKeyType(config.LeafKeyType)
+	certMgr.SetLeafCache(config.LeafCacheSize, config.PersistLeafCerts)
 
 	ps := &ProxyServer{
 		proxy:      goproxy.NewProxyHttpServer(),
@@ -85,15 +115,25 @@ func NewProxyServer(dataDir string, config *models.ProxyConfig) (*ProxyServer, e
 		cacheHead:  0,
 		cacheTail:  0,
 		cacheCount: 0,
+		intercept:  newInterceptQueue(),
+		wsRelays:   make(map[int]*wsRelay),
+		listeners:  make(map[string]*proxyListener),
 	}
 
 	// Configure proxy
 	ps.proxy.Verbose = false
 
-	// Set up SSL interception if enabled
-	if config.SSLInterception {
-		ps.setupSSLInterception()
-	}
+	// Set up SSL interception (enabled per listener)
+	ps.setupSSLInterception()
+
+	// Route outbound traffic through upstream proxies
+	ps.setupUpstream()
+
+	// Set up upstream transports (after upstream routing so they share it)
+	ps.setupTransports()
+
+	// Serve the landing page ahead of the capture handlers
+	ps.setupLandingPage()
 
 	// Set up request/response handlers
 	ps.setupHandlers()
@@ -110,35 +150,36 @@ func (ps *ProxyServer) setupSSLInterception() {
 		return
 	}
 
-	// Configure MITM handler with certificate generation
-	ps.proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
-
-	// Set custom certificate generation function
-	goproxy.GoproxyCa = *caCert
-	goproxy.MitmConnect = &goproxy.ConnectAction{
-		Action:    goproxy.ConnectMitm,
-		TLSConfig: ps.generateTLSConfig,
-	}
+	// Configure MITM handler, listeners decide whether to intercept
+	ps.proxy.OnRequest().HandleConnectFunc(ps.handleConnect)
 }
 
-// generateTLSConfig generates TLS config with dynamic certificate generation
-func (ps *ProxyServer) generateTLSConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
-	// Extract hostname without port
-	hostname := host
-	if h, _, err := net.SplitHostPort(host); err == nil {
-		hostname = h
-	}
-
-	// Generate certificate for this hostname
-	cert, err := ps.certMgr.GenerateServerCertificate(hostname)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate certificate for %s: %w", hostname, err)
+// generateTLSConfig generates TLS config with dynamic certificate generation.
+// Certificates are named after the client's SNI, falling back to host.
+func (ps *ProxyServer) generateTLSConfig(host string) *tls.Config {
+	// Offer HTTP/2 so clients are not silently downgraded
+	nextProtos := []string{"h2", "http/1.1"}
+	if ps.GetConfig().DisableHTTP2 {
+		nextProtos = []string{"http/1.1"}
 	}
 
 	return &tls.Config{
-		Certificates: []tls.Certificate{*cert},
-		MinVersion:   tls.VersionTLS12,
-	}, nil
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			hostname := hello.ServerName
+			if hostname == "" {
+				hostname = stripPort(host)
+			}
+
+			// Generate certificate for this hostname
+			cert, err := ps.certMgr.GenerateServerCertificate(hostname)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate certificate for %s: %w", hostname, err)
+			}
+			return cert, nil
+		},
+	}
 }
 
 // setupHandlers configures request and response interceptors
@@ -147,34 +188,99 @@ func (ps *ProxyServer) setupHandlers() {
 	ps.proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		startTime := time.Now()
 		reqID := atomic.AddInt64(&ps.requestID, 1)
+		lc, _ := listenerFor(req)
 
 		// Store request start time in context for response handler
 		ctx.UserData = map[string]interface{}{
 			"startTime": startTime,
 			"reqID":     reqID,
+			"listener":  lc,
 		}
 
 		// Sanitize and add custom headers
-		ps.sanitizeHeaders(req)
-		ps.addCustomHeaders(req)
+		addedHeaders, removedHeaders := ps.sanitizeHeaders(req)
+		customHeaders, replacedHeaders := ps.addCustomHeaders(req)
+		addedHeaders = append(addedHeaders, customHeaders...)
+
+		// Overwriting a header the sanitizer injected still counts as adding it
+		replacedHeaders = slices.DeleteFunc(replacedHeaders, func(h string) bool {
+			return slices.Contains(addedHeaders, h)
+		})
+
+		// Compressed WebSocket frames can't be inspected, so don't negotiate it
+		if isWebSocketUpgrade(req.Header) && req.Header.Get("Sec-WebSocket-Extensions") != "" {
+			req.Header.Del("Sec-WebSocket-Extensions")
+			removedHeaders = append(removedHeaders, "Sec-WebSocket-Extensions")
+		}
+		ctx.UserData.(map[string]interface{})["addedHeaders"] = addedHeaders
+		ctx.UserData.(map[string]interface{})["removedHeaders"] = removedHeaders
+		ctx.UserData.(map[string]interface{})["replacedHeaders"] = replacedHeaders
+
+		// Speak the client's HTTP version to the upstream where possible
+		ctx.RoundTripper = ps.upstreamRoundTripper(req)
+
+		// Apply match-and-replace rules
+		appliedRules := ps.applyRequestRules(req)
+		ctx.UserData.(map[string]interface{})["appliedRules"] = appliedRules
 
-		// Capture request details
+		// Capture request details, before holding so held requests are listed
+		intercepted := shouldIntercept(ps.GetConfig().Intercept, req)
 		details := ps.captureRequest(req, reqID, startTime)
+		details.Listener = lc.ID
+		details.Intercepted = intercepted
+		details.AppliedRules = appliedRules
+		details.AddedHeaders = addedHeaders
+		details.RemovedHeaders = removedHeaders
+		details.ReplacedHeaders = replacedHeaders
 
 		// Check scope and emit request
-		if ps.shouldSave(details.Host) {
+		save := ps.shouldSave(req.URL)
+		if save {
 			ps.emitRequest(details)
 		}
 
+		// Hold the request for manual review if intercept mode applies
+		var dropped *http.Response
+		if intercepted {
+			heldAt := time.Now()
+			orig := req
+			var action string
+			req, dropped, action = ps.interceptRequest(req, reqID)
+			heldTime := time.Since(heldAt).Milliseconds()
+
+			ctx.Req = req
+			ctx.UserData.(map[string]interface{})["intercepted"] = true
+			ctx.UserData.(map[string]interface{})["interceptAction"] = action
+			ctx.UserData.(map[string]interface{})["heldTime"] = heldTime
+
+			// Record the outcome, and the request as edited
+			if save {
+				if req != orig {
+					edited := ps.captureRequest(req, reqID, startTime)
+					edited.Listener = details.Listener
+					edited.Intercepted = true
+					edited.AppliedRules = details.AppliedRules
+					edited.AddedHeaders = details.AddedHeaders
+					edited.RemovedHeaders = details.RemovedHeaders
+					edited.ReplacedHeaders = details.ReplacedHeaders
+					details = edited
+				}
+				details.InterceptAction = action
+				details.HeldTime = heldTime
+				ps.updateInCache(details)
+			}
+		}
+
+		if dropped != nil {
+			ctx.UserData.(map[string]interface{})["dropped"] = true
+			return req, dropped
+		}
+
 		return req, nil
 	})
 
 	// Response handler - intercept all responses
 	ps.proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-		if resp == nil || ctx.UserData == nil {
-			return resp
-		}
-
 		userData, ok := ctx.UserData.(map[string]interface{})
 		if !ok {
 			return resp
@@ -182,13 +288,74 @@ func (ps *ProxyServer) setupHandlers() {
 
 		startTime, _ := userData["startTime"].(time.Time)
 		reqID, _ := userData["reqID"].(int64)
+		dropped, _ := userData["dropped"].(bool)
+		intercepted, _ := userData["intercepted"].(bool)
+		appliedRules, _ := userData["appliedRules"].([]string)
+		lc, _ := userData["listener"].(models.ListenerConfig)
+		timing, _ := userData["timing"].(*upstreamTiming)
+		addedHeaders, _ := userData["addedHeaders"].([]string)
+		removedHeaders, _ := userData["removedHeaders"].([]string)
+		replacedHeaders, _ := userData["replacedHeaders"].([]string)
+		interceptAction, _ := userData["interceptAction"].(string)
+		heldTime, _ := userData["heldTime"].(int64)
+
+		// The upstream could not be reached, record why before goproxy answers with a 500
+		if resp == nil {
+			if ctx.Error != nil {
+				details := ps.captureError(ctx.Req, ctx.Error, reqID, startTime)
+				details.Listener = lc.ID
+				details.Intercepted = intercepted
+				details.InterceptAction = interceptAction
+				details.HeldTime = heldTime
+				details.AppliedRules = appliedRules
+				details.AddedHeaders = addedHeaders
+				details.RemovedHeaders = removedHeaders
+				details.ReplacedHeaders = replacedHeaders
+				timing.apply(&details)
+				if ps.shouldSave(ctx.Req.URL) {
+					ps.emitResponse(details)
+				}
+			}
+			return resp
+		}
+
+		// Apply match-and-replace rules
+		if !dropped {
+			appliedRules = append(appliedRules, ps.applyResponseRules(resp, ctx.Req.Host)...)
+		}
+
+		// Hold the response for manual review if intercept mode applies
+		// (upgrades and streams would never finish buffering for review)
+		upgraded := resp.StatusCode == http.StatusSwitchingProtocols
+		streaming := isStreamingResponse(resp)
+		if cfg := ps.GetConfig().Intercept; !dropped && !upgraded && !streaming && cfg.InterceptResponses && shouldIntercept(cfg, ctx.Req) {
+			resp = ps.interceptResponse(resp, ctx.Req, reqID)
+		}
 
 		// Capture response details
 		details := ps.captureResponse(ctx.Req, resp, reqID, startTime)
+		details.Listener = lc.ID
+		details.Intercepted = intercepted
+		details.InterceptAction = interceptAction
+		details.HeldTime = heldTime
+		details.AppliedRules = appliedRules
+		details.AddedHeaders = addedHeaders
+		details.RemovedHeaders = removedHeaders
+		details.ReplacedHeaders = replacedHeaders
+		if dropped {
+			details.Error = "request dropped by user"
+		}
 
-		// Check scope and emit response
-		if ps.shouldSave(details.Host) {
-			ps.emitResponse(details)
+		// Check scope and emit response once its body has been relayed
+		if ps.shouldSave(ctx.Req.URL) {
+			ps.captureResponseBody(resp, details, timing)
+		}
+
+		// Record the frames of upgraded WebSocket connections
+		if upgraded && isWebSocketUpgrade(resp.Header) {
+			if upstream, ok := resp.Body.(io.ReadWriteCloser); ok {
+				resp.Body = ps.newWSRelay(upstream, ctx.Req, int(reqID))
+			}
 		}
 
 		return resp
@@ -197,76 +364,38 @@ func (ps *ProxyServer) setupHandlers() {
 
 // captureRequest captures request details
 func (ps *ProxyServer) captureRequest(req *http.Request, reqID int64, startTime time.Time) models.RequestDetails {
-	protocol := "http"
-
-	// Check if this was originally an HTTPS request by looking at the URL scheme
-	// In MITM proxy scenarios, the request URL scheme might indicate the original protocol
-	if req.URL != nil && req.URL.Scheme == "https" {
-		protocol = "https"
-	} else if req.TLS != nil {
-		// Fallback to TLS check for direct HTTPS requests
-		protocol = "https"
-	}
-
-	// Read and buffer request body
-	var body string
+	// Read and buffer request body, the whole body is still forwarded
+	var body, bodyEncoding string
+	var truncated bool
 	if req.Body != nil {
-		bodyBytes, err := io.ReadAll(io.LimitReader(req.Body, MaxBodySize))
+		bodyBytes, more, err := peekBody(&req.Body, ps.captureLimit())
 		if err == nil && len(bodyBytes) > 0 {
-			body = string(bodyBytes)
-			// Restore body for forwarding
-			req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+			body, bodyEncoding = encodeBody(bodyBytes)
+			truncated = more
 		}
 	}
 
 	return models.RequestDetails{
-		ID:        int(reqID),
-		Host:      req.Host,
-		Method:    req.Method,
-		Path:      req.URL.Path,
-		Query:     req.URL.RawQuery,
-		Headers:   req.Header.Clone(),
-		Timestamp: startTime,
-		Protocol:  protocol,
-		Body:      body,
+		ID:            int(reqID),
+		Host:          req.Host,
+		Method:        req.Method,
+		Path:          req.URL.Path,
+		Query:         req.URL.RawQuery,
+		Headers:       req.Header.Clone(),
+		Timestamp:     startTime,
+		Protocol:      requestProtocol(req),
+		HTTPVersion:   req.Proto,
+		ClientTLS:     clientHelloFor(req),
+		Body:          body,
+		BodyEncoding:  bodyEncoding,
+		BodyTruncated: truncated,
 	}
 }
 
-// captureResponse captures response details
+// captureResponse captures response details, the body is recorded by captureResponseBody
 func (ps *ProxyServer) captureResponse(req *http.Request, resp *http.Response, reqID int64, startTime time.Time) models.RequestDetails {
 	responseTime := time.Since(startTime).Milliseconds()
 
-	protocol := "http"
-
-	// Check if this was originally an HTTPS request by looking at the URL scheme
-	// In MITM proxy scenarios, the request URL scheme might indicate the original protocol
-	if req.URL != nil && req.URL.Scheme == "https" {
-		protocol = "https"
-	} else if req.TLS != nil {
-		// Fallback to TLS check for direct HTTPS requests
-		protocol = "https"
-	}
-
-	// Read and decompress response body
-	var responseBody string
-	var contentLength int
-
-	if resp.Body != nil && shouldCaptureBody(resp.Header.Get("Content-Type")) {
-		bodyBytes, err := io.ReadAll(io.LimitReader(resp.Body, MaxBodySize))
-		if err == nil {
-			contentLength = len(bodyBytes)
-
-			// Decompress if needed
-			decompressed, err := decompressResponse(bodyBytes, resp.Header.Get("Content-Encoding"))
-			if err == nil {
-				responseBody = string(decompressed)
-			}
-
-			// Restore body for client
-			resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-		}
-	}
-
 	return models.RequestDetails{
 		ID:              int(reqID),
 		Host:            req.Host,
@@ -275,145 +404,118 @@ func (ps *ProxyServer) captureResponse(req *http.Request, resp *http.Response, r
 		Query:           req.URL.RawQuery,
 		Headers:         req.Header.Clone(),
 		Timestamp:       startTime,
-		ResponseLength:  contentLength,
 		Status:          resp.StatusCode,
 		ResponseTime:    responseTime,
-		Protocol:        protocol,
+		Protocol:        requestProtocol(req),
+		HTTPVersion:     req.Proto,
+		UpstreamVersion: resp.Proto,
+		UpstreamTLS:     ps.upstreamTLSInfo(resp.TLS, req.URL.Host),
+		ClientTLS:       clientHelloFor(req),
 		ResponseHeaders: resp.Header.Clone(),
-		ResponseBody:    responseBody,
 	}
 }
 
-// decompressResponse decompresses response data based on encoding
-func decompressResponse(data []byte, encoding string) ([]byte, error) {
-	if encoding == "" {
-		return data, nil
-	}
-
-	encoding = strings.ToLower(encoding)
-
-	if strings.Contains(encoding, "gzip") {
-		reader, err := gzip.NewReader(bytes.NewReader(data))
-		if err != nil {
-			return data, err
-		}
-		defer reader.Close()
-		return io.ReadAll(reader)
-	} else if strings.Contains(encoding, "br") {
-		reader := brotli.NewReader(bytes.NewReader(data))
-		return io.ReadAll(reader)
-	} else if strings.Contains(encoding, "deflate") {
-		// Deflate is more complex - try both raw and zlib
-		// For simplicity, return as-is (can enhance later)
-		return data, nil
+// requestProtocol reports whether a request was made over http or https
+func requestProtocol(req *http.Request) string {
+	// Check if this was originally an HTTPS request by looking at the URL scheme
+	// In MITM proxy scenarios, the request URL scheme might indicate the original protocol
+	if req.URL != nil && req.URL.Scheme == "https" {
+		return "https"
+	} else if req.TLS != nil {
+		// Fallback to TLS check for direct HTTPS requests
+		return "https"
 	}
-
-	return data, nil
+	return "http"
 }
 
-// shouldCaptureBody checks if body should be captured based on content type
-func shouldCaptureBody(contentType string) bool {
-	if contentType == "" {
-		return true
-	}
-
-	contentType = strings.ToLower(contentType)
-	textTypes := []string{
-		"text/",
-		"application/json",
-		"application/xml",
-		"application/javascript",
-		"application/x-www-form-urlencoded",
-		"application/graphql",
-	}
-
-	for _, t := range textTypes {
-		if strings.Contains(contentType, t) {
-			return true
-		}
-	}
-
-	return false
+// defaultStripHeaders are removed when no strip list is configured
+var defaultStripHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-IP",
+	"Via",
+	"Forwarded",
+	"Proxy-Connection",
 }
 
-// sanitizeHeaders removes proxy-revealing headers and adds browser-like headers
-func (ps *ProxyServer) sanitizeHeaders(req *http.Request) {
-	// Remove proxy-revealing headers
-	proxyHeaders := []string{
-		"X-Forwarded-For",
-		"X-Forwarded-Host",
-		"X-Forwarded-Proto",
-		"X-Real-IP",
-		"Via",
-		"Forwarded",
-		"Proxy-Connection",
-	}
+// defaultInjectHeaders are added when missing if no inject list is configured
+var defaultInjectHeaders = map[string]string{
+	"User-Agent":      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36",
+	"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8",
+	"Accept-Language": "en-US,en;q=0.9",
+}
 
-	for _, h := range proxyHeaders {
-		req.Header.Del(h)
-	}
+// sanitizeHeaders applies the header sanitization profile, removing
+// proxy-revealing headers and adding browser-like ones. It returns the names
+// of the headers it added and removed.
+func (ps *ProxyServer) sanitizeHeaders(req *http.Request) (added, removed []string) {
+	profile := ps.GetConfig().HeaderSanitization
 
-	// Add realistic browser headers if missing
-	if req.Header.Get("User-Agent") == "" {
-		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
-	}
+	if !profile.DisableStrip {
+		strip := profile.StripHeaders
+		if strip == nil {
+			strip = defaultStripHeaders
+		}
 
-	if req.Header.Get("Accept") == "" {
-		req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8")
+		for _, h := range strip {
+			if _, ok := req.Header[http.CanonicalHeaderKey(h)]; ok {
+				req.Header.Del(h)
+				removed = append(removed, http.CanonicalHeaderKey(h))
+			}
+		}
 	}
 
-	if req.Header.Get("Accept-Language") == "" {
-		req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	}
+	if !profile.DisableInject {
+		inject := profile.InjectHeaders
+		if inject == nil {
+			inject = defaultInjectHeaders
+		}
 
-	if req.Header.Get("Accept-Encoding") == "" {
-		req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+		for _, h := range sortedKeys(inject) {
+			if req.Header.Get(h) == "" {
+				req.Header.Set(h, inject[h])
+				added = append(added, http.CanonicalHeaderKey(h))
+			}
+		}
 	}
-}
 
-// addCustomHeaders adds custom headers to the request
-func (ps *ProxyServer) addCustomHeaders(req *http.Request) {
-	for key, value := range ps.config.CustomHeaders {
-		req.Header.Set(key, value)
-	}
+	// Accept-Encoding is never injected: responses are relayed still encoded
+	// (see setupTransports), so clients only get encodings they can decode
+	return added, removed
 }
 
-// shouldSave checks if request should be saved based on scope
-func (ps *ProxyServer) shouldSave(host string) bool {
-	if !ps.config.SaveOnlyInScope {
-		return true
-	}
-
-	// Check out-of-scope first (exclusions take precedence)
-	for _, pattern := range ps.config.OutOfScope {
-		if matchesPattern(host, pattern) {
-			return false
-		}
-	}
-
-	// Check in-scope patterns
-	for _, pattern := range ps.config.InScope {
-		if matchesPattern(host, pattern) {
-			return true
+// addCustomHeaders sets custom headers on the request. It returns the names of
+// the headers it added and of those that overwrote a value already present.
+func (ps *ProxyServer) addCustomHeaders(req *http.Request) (added, replaced []string) {
+	for _, key := range sortedKeys(ps.config.CustomHeaders) {
+		name := http.CanonicalHeaderKey(key)
+		if _, ok := req.Header[name]; ok {
+			replaced = append(replaced, name)
+		} else {
+			added = append(added, name)
 		}
+		req.Header.Set(key, ps.config.CustomHeaders[key])
 	}
-
-	return false
+	return added, replaced
 }
 
-// matchesPattern checks if host matches a scope pattern (supports wildcards)
-func matchesPattern(host, pattern string) bool {
-	if pattern == host {
-		return true
+// sortedKeys returns the keys of a header map in a stable order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	// Wildcard match (e.g., *.example.com)
-	if strings.HasPrefix(pattern, "*.") {
-		domain := pattern[2:]
-		return strings.HasSuffix(host, domain) || host == domain
+// stripPort removes the port from a host:port string
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
 	}
-
-	return false
+	return host
 }
 
 // emitRequest emits a request event and adds to batch
@@ -531,6 +633,12 @@ func (ps *ProxyServer) updateInCache(resp models.RequestDetails) {
 	for i := 0; i < ps.cacheCount; i++ {
 		idx := (ps.cacheHead + i) % MaxCachedRequests
 		if ps.reqCache[idx].ID == resp.ID {
+			// The response record does not carry the request body
+			if resp.Body == "" {
+				resp.Body = ps.reqCache[idx].Body
+				resp.BodyEncoding = ps.reqCache[idx].BodyEncoding
+				resp.BodyTruncated = ps.reqCache[idx].BodyTruncated
+			}
 			ps.reqCache[idx] = resp
 			break
 		}
@@ -561,10 +669,15 @@ func (ps *ProxyServer) ClearRequests() {
 	ps.cacheHead = 0
 	ps.cacheTail = 0
 	ps.cacheCount = 0
+
+	// WebSocket messages belong to the cleared handshakes
+	ps.wsHistory.clear()
 }
 
-// Start starts the proxy server
+// Start starts the proxy server listeners
 func (ps *ProxyServer) Start() error {
+	configs := ps.listenerConfigs()
+
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
@@ -572,28 +685,27 @@ func (ps *ProxyServer) Start() error {
 		return fmt.Errorf("proxy server already running")
 	}
 
-	addr := fmt.Sprintf(":%d", ps.config.Port)
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to start proxy server: %w", err)
-	}
-
-	ps.listener = listener
-	ps.isRunning = true
+	// The default listener must come up, additional ones are best effort
+	for _, lc := range configs {
+		if !lc.AutoStart {
+			continue
+		}
 
-	go func() {
-		log.Printf("Proxy server listening on %s\n", addr)
-		if err := http.Serve(listener, ps.proxy); err != nil {
-			if ps.isRunning {
-				log.Printf("Proxy server error: %v\n", err)
+		if err := ps.startListener(lc); err != nil {
+			if lc.ID == models.DefaultListenerID {
+				ps.stopAllListeners()
+				return fmt.Errorf("failed to start proxy server: %w", err)
 			}
+			log.Printf("Warning: %v\n", err)
 		}
-	}()
+	}
+
+	ps.isRunning = true
 
 	return nil
 }
 
-// Stop stops the proxy server
+// Stop stops the proxy server and all of its listeners
 func (ps *ProxyServer) Stop() error {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
@@ -605,11 +717,9 @@ func (ps *ProxyServer) Stop() error {
 	// Flush any pending batches
 	ps.flushBatches()
 
-	// Close listener
-	if ps.listener != nil {
-		if err := ps.listener.Close(); err != nil {
-			return fmt.Errorf("failed to stop proxy server: %w", err)
-		}
+	// Close listeners
+	if err := ps.stopAllListeners(); err != nil {
+		return fmt.Errorf("failed to stop proxy server: %w", err)
 	}
 
 	ps.isRunning = false
@@ -618,6 +728,17 @@ func (ps *ProxyServer) Stop() error {
 	return nil
 }
 
+// stopAllListeners closes every running listener. Caller must hold ps.mu.
+func (ps *ProxyServer) stopAllListeners() error {
+	var firstErr error
+	for id := range ps.listeners {
+		if err := ps.stopListener(id); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // IsRunning returns whether the proxy server is running
 func (ps *ProxyServer) IsRunning() bool {
 	ps.mu.RLock()
@@ -627,6 +748,8 @@ func (ps *ProxyServer) IsRunning() bool {
 
 // GetStatus returns the current proxy status
 func (ps *ProxyServer) GetStatus() models.ProxyStatus {
+	configs := ps.listenerConfigs()
+
 	ps.mu.RLock()
 	defer ps.mu.RUnlock()
 
@@ -634,15 +757,36 @@ func (ps *ProxyServer) GetStatus() models.ProxyStatus {
 		IsRunning:       ps.isRunning,
 		Port:            ps.config.Port,
 		CertificatePath: ps.config.CertPath,
+		Listeners:       ps.listenerStatuses(configs),
 	}
 }
 
-// UpdateConfig updates the proxy configuration
-func (ps *ProxyServer) UpdateConfig(config *models.ProxyConfig) {
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
+// UpdateConfig validates and applies a new proxy configuration
+func (ps *ProxyServer) UpdateConfig(config *models.ProxyConfig) error {
+	if err := validateListeners(config.Listeners); err != nil {
+		return err
+	}
 
+	ps.mu.Lock()
 	ps.config = config
+	ps.mu.Unlock()
+
+	// Drop the regexes of rules that are gone
+	compiledRules.Clear()
+
+	ps.certMgr.SetWildcardMode(config.WildcardCertificates)
+	ps.certMgr.SetCopyUpstreamSANs(config.CopyUpstreamSANs)
+	ps.certMgr.SetLeafKeyType(config.LeafKeyType)
+	ps.certMgr.SetLeafCache(config.LeafCacheSize, config.PersistLeafCerts)
+
+	// Turning intercept mode off lets everything that is held through
+	if !config.Intercept.Enabled {
+		ps.intercept.releaseAll()
+	} else if !config.Intercept.InterceptWebSockets {
+		ps.intercept.releaseType("websocket")
+	}
+
+	return nil
 }
 
 // GetConfig returns the current configuration
@@ -663,6 +807,11 @@ func (ps *ProxyServer) SetOnResponse(callback func(models.RequestDetails)) {
 	ps.onResponse = callback
 }
 
+// SetOnIntercept sets the callback for intercept queue events
+func (ps *ProxyServer) SetOnIntercept(callback func(string, models.InterceptedItem)) {
+	ps.intercept.setOnEvent(callback)
+}
+
 // SetOnBatchFlush sets the callback for batch flush events
 func (ps *ProxyServer) SetOnBatchFlush(callback func([]models.RequestDetails, []models.RequestDetails)) {
 	ps.onBatchFlush = callback
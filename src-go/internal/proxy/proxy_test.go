@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// TestCustomHeadersRecorded checks that custom headers are recorded as added
+// or, when they overwrite what the client sent, as replaced
+func TestCustomHeadersRecorded(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	ps, err := NewProxyServer(t.TempDir(), &models.ProxyConfig{
+		CustomHeaders: map[string]string{
+			"x-client":   "proxy",  // Sent by the client
+			"X-New":      "proxy",  // Not sent by anyone
+			"User-Agent": "custom", // Injected by the sanitizer
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(ps.proxy)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.Header.Set("X-Client", "client")
+	req.Header.Set("User-Agent", "")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got.Get("X-Client") != "proxy" || got.Get("User-Agent") != "custom" {
+		t.Fatalf("custom headers not sent: %v", got)
+	}
+
+	record := ps.GetRequests()[0]
+	if !slices.Equal(record.ReplacedHeaders, []string{"X-Client"}) {
+		t.Errorf("ReplacedHeaders = %v, want [X-Client]", record.ReplacedHeaders)
+	}
+	for _, h := range []string{"X-New", "User-Agent"} {
+		if !slices.Contains(record.AddedHeaders, h) {
+			t.Errorf("AddedHeaders = %v, missing %s", record.AddedHeaders, h)
+		}
+	}
+	if slices.Contains(record.AddedHeaders, "X-Client") {
+		t.Errorf("AddedHeaders = %v, lists the replaced X-Client", record.AddedHeaders)
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// shouldSave checks if a request to u should be saved based on scope
+func (ps *ProxyServer) shouldSave(u *url.URL) bool {
+	if !ps.GetConfig().SaveOnlyInScope {
+		return true
+	}
+	return ps.InScope(u)
+}
+
+// InScope evaluates the scope rules and the InScope/OutOfScope host patterns
+// for u. Exclusions take precedence; nothing is in scope without an include.
+func (ps *ProxyServer) InScope(u *url.URL) bool {
+	return ps.evaluateScope(u, false)
+}
+
+// hostMayBeInScope checks whether any URL on u's host can be in scope, for
+// decisions made before the path is known
+func (ps *ProxyServer) hostMayBeInScope(u *url.URL) bool {
+	return ps.evaluateScope(u, true)
+}
+
+// evaluateScope implements InScope. With anyPath set, path conditions are
+// treated as met by includes and excludes only apply to whole hosts.
+func (ps *ProxyServer) evaluateScope(u *url.URL, anyPath bool) bool {
+	config := ps.GetConfig()
+	host := hostWithDefaultPort(u.Host, u.Scheme)
+
+	// Check out-of-scope first (exclusions take precedence)
+	for _, pattern := range config.OutOfScope {
+		if matchesPattern(host, pattern) {
+			return false
+		}
+	}
+	for _, rule := range config.ScopeRules {
+		if !rule.Enabled || rule.Action != models.ScopeExclude {
+			continue
+		}
+		if anyPath && (rule.PathPrefix != "" || rule.PathRegex != "") {
+			continue
+		}
+		if matchesScopeRule(rule, u, false) {
+			return false
+		}
+	}
+
+	// Check in-scope patterns
+	for _, pattern := range config.InScope {
+		if matchesPattern(host, pattern) {
+			return true
+		}
+	}
+	for _, rule := range config.ScopeRules {
+		if rule.Enabled && rule.Action == models.ScopeInclude && matchesScopeRule(rule, u, anyPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesScopeRule checks every condition a scope rule sets against u,
+// skipping the path conditions if ignorePath is set
+func matchesScopeRule(rule models.ScopeRule, u *url.URL, ignorePath bool) bool {
+	scheme := strings.ToLower(u.Scheme)
+	if rule.Scheme != "" && !strings.EqualFold(rule.Scheme, scheme) {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if rule.Host != "" {
+		if rule.HostRegex {
+			re, err := compileRule(rule.Host)
+			if err != nil {
+				log.Printf("Scope: invalid host regex %q: %v\n", rule.Host, err)
+				return false
+			}
+			if !re.MatchString(host) {
+				return false
+			}
+		} else if !matchesPattern(host, rule.Host) {
+			return false
+		}
+	}
+
+	if rule.Port != 0 && rule.Port != urlPort(u) {
+		return false
+	}
+
+	if rule.CIDR != "" && !matchesCIDR(host, rule.CIDR) {
+		return false
+	}
+
+	if ignorePath {
+		return true
+	}
+
+	if rule.PathPrefix != "" && !strings.HasPrefix(u.Path, rule.PathPrefix) {
+		return false
+	}
+
+	if rule.PathRegex != "" {
+		re, err := compileRule(rule.PathRegex)
+		if err != nil {
+			log.Printf("Scope: invalid path regex %q: %v\n", rule.PathRegex, err)
+			return false
+		}
+		if !re.MatchString(u.Path) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// urlPort returns the port of u, defaulting to the scheme's port
+func urlPort(u *url.URL) int {
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, "https") || strings.EqualFold(u.Scheme, "wss") {
+		return 443
+	}
+	return 80
+}
+
+// matchesCIDR checks whether host is an IP address within cidr, which may
+// also be a single address. Host names are not resolved, so CIDR rules only
+// match requests made to literal IPs; resolving every request would be slow
+// and could disagree with the address the transport dials.
+func matchesCIDR(host, cidr string) bool {
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	if !strings.Contains(cidr, "/") {
+		single, err := netip.ParseAddr(cidr)
+		return err == nil && single.Unmap() == addr
+	}
+
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		log.Printf("Scope: invalid CIDR %q: %v\n", cidr, err)
+		return false
+	}
+	return prefix.Contains(addr)
+}
+
+// matchesPattern checks if host matches a host pattern. "*.example.com"
+// matches example.com and its subdomains, other wildcards are globs. A
+// pattern with a port only matches that port, otherwise the port is ignored.
+func matchesPattern(host, pattern string) bool {
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+
+	if patternHost, patternPort, err := net.SplitHostPort(pattern); err == nil {
+		hostName, hostPort, err := net.SplitHostPort(host)
+		if err != nil || hostPort != patternPort {
+			return false
+		}
+		host, pattern = hostName, patternHost
+	} else {
+		host = strings.Trim(stripPort(host), "[]")
+	}
+
+	if pattern == "*" || pattern == host {
+		return true
+	}
+
+	// Wildcard match (e.g., *.example.com)
+	if strings.HasPrefix(pattern, "*.") && !strings.ContainsAny(pattern[2:], "*?[") {
+		domain := pattern[2:]
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, err := path.Match(pattern, host)
+		return err == nil && matched
+	}
+
+	return false
+}
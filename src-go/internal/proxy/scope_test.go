@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+func TestMatchesPattern(t *testing.T) {
+	tests := []struct {
+		host, pattern string
+		want          bool
+	}{
+		// Exact
+		{"example.com", "example.com", true},
+		{"EXAMPLE.com", "example.COM", true},
+		{"www.example.com", "example.com", false},
+		{"anything.test", "*", true},
+
+		// Suffix wildcards cover the domain and its subdomains only
+		{"example.com", "*.example.com", true},
+		{"www.example.com", "*.example.com", true},
+		{"a.b.example.com", "*.example.com", true},
+		{"evilexample.com", "*.example.com", false},
+		{"example.com.evil.net", "*.example.com", false},
+
+		// Ports
+		{"example.com:443", "example.com", true},
+		{"example.com:8443", "example.com:8443", true},
+		{"example.com:443", "example.com:8443", false},
+		{"example.com", "example.com:443", false},
+		{"www.example.com:8443", "*.example.com:8443", true},
+		{"www.example.com:443", "*.example.com:8443", false},
+		{"[::1]:443", "::1", true},
+		{"[::1]:443", "[::1]:443", true},
+
+		// Globs
+		{"api1.example.com", "api?.example.com", true},
+		{"api12.example.com", "api?.example.com", false},
+		{"api-eu.example.com", "api-*.example.com", true},
+		{"api.eu.example.com", "api-*.example.com", false},
+		{"www.example.org", "www.example.*", true},
+		{"b.example.com", "[ab].example.com", true},
+		{"c.example.com", "[ab].example.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesPattern(tt.host, tt.pattern); got != tt.want {
+			t.Errorf("matchesPattern(%q, %q) = %v, want %v", tt.host, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesCIDR(t *testing.T) {
+	tests := []struct {
+		host, cidr string
+		want       bool
+	}{
+		{"10.1.2.3", "10.0.0.0/8", true},
+		{"11.1.2.3", "10.0.0.0/8", false},
+		{"10.1.2.3", "10.1.2.3", true},
+		{"::ffff:10.1.2.3", "10.0.0.0/8", true},
+		{"[2001:db8::1]", "2001:db8::/32", true},
+		{"localhost", "127.0.0.0/8", false}, // Names are not resolved
+		{"10.1.2.3", "not a cidr/8", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesCIDR(tt.host, tt.cidr); got != tt.want {
+			t.Errorf("matchesCIDR(%q, %q) = %v, want %v", tt.host, tt.cidr, got, tt.want)
+		}
+	}
+}
+
+// TestCompiledRulesCleared checks that config updates drop cached regexes
+func TestCompiledRulesCleared(t *testing.T) {
+	ps, err := NewProxyServer(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := compileRule(`^old-rule$`); err != nil {
+		t.Fatal(err)
+	}
+	ps.UpdateConfig(&models.ProxyConfig{})
+
+	if _, ok := compiledRules.Load(`^old-rule$`); ok {
+		t.Error("regex of a removed rule is still cached")
+	}
+}
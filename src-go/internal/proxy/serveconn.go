@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+	"golang.org/x/net/http2"
+)
+
+const SniffTimeout = 10 * time.Second
+
+// httpMethodPrefixes are used to recognize plaintext HTTP on a raw connection
+var httpMethodPrefixes = []string{"GET ", "POST ", "PUT ", "DELETE ", "HEAD ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT "}
+
+// acceptConns hands each connection accepted on listener to handle in its own goroutine
+func acceptConns(listener net.Listener, name string, handle func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("%s listener error: %v\n", name, err)
+			}
+			return
+		}
+
+		go handle(conn)
+	}
+}
+
+// serveConn feeds a raw client connection for target (host:port) into the
+// capture pipeline. TLS is MITM'd with a generated certificate, plaintext
+// HTTP is served directly and anything else is tunneled untouched. An empty
+// target (invisible mode) is resolved from each request's Host header instead;
+// the TLS SNI then only names the generated certificate.
+func (ps *ProxyServer) serveConn(conn net.Conn, target string, lc models.ListenerConfig) {
+	// Large enough to peek a whole ClientHello record
+	br := bufio.NewReaderSize(conn, MaxTLSRecordSize)
+
+	conn.SetReadDeadline(time.Now().Add(SniffTimeout))
+	first, err := br.Peek(1)
+	isHTTP := err == nil && first[0] != 0x16 && looksLikeHTTP(br)
+	conn.SetReadDeadline(time.Time{})
+
+	client := newBufferedConn(conn, br)
+
+	switch {
+	case err != nil:
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && target != "" {
+			// The client is waiting for the server to speak first
+			ps.tunnelConn(client, target)
+			return
+		}
+		conn.Close()
+
+	case first[0] == 0x16: // TLS handshake record
+		if !lc.SSLInterception && target != "" {
+			ps.tunnelConn(client, target)
+			return
+		}
+
+		conn.SetReadDeadline(time.Now().Add(SniffTimeout))
+		hello, err := peekClientHello(br)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("Could not fingerprint ClientHello from %s: %v\n", conn.RemoteAddr(), err)
+		}
+
+		// Pinned and out-of-scope hosts are tunneled without decryption
+		if name := passthroughTarget(target, hello); name != "" && ps.shouldPassthrough(name) {
+			if target == "" {
+				target = name
+			}
+			ps.tunnelConn(client, target)
+			return
+		}
+
+		ps.serveTLSConn(client, target, lc, hello)
+
+	case isHTTP:
+		ps.serveHTTPConn(client, ps.connHandler("http", target, lc, nil))
+
+	case target != "":
+		ps.tunnelConn(client, target)
+
+	default:
+		log.Printf("Invisible proxy: cannot determine target for non-HTTP connection from %s\n", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// looksLikeHTTP checks whether the buffered bytes start with an HTTP method
+func looksLikeHTTP(br *bufio.Reader) bool {
+	peek, _ := br.Peek(8)
+	for _, prefix := range httpMethodPrefixes {
+		if bytes.HasPrefix(peek, []byte(prefix)) || strings.HasPrefix(prefix, string(peek)) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTLSConn terminates TLS with a certificate for the requested name and
+// serves the decrypted HTTP/1.1 or HTTP/2, whichever ALPN picked. hello is the
+// client's fingerprinted ClientHello, if it could be parsed.
+func (ps *ProxyServer) serveTLSConn(conn net.Conn, target string, lc models.ListenerConfig, hello *models.ClientHello) {
+	certHost := target
+	if certHost == "" {
+		// No CONNECT target in invisible mode, the client most likely dialed our IP
+		certHost = conn.LocalAddr().String()
+	}
+
+	tlsConfig := ps.generateTLSConfig(certHost)
+
+	// Remember the SNI so failed handshakes can be attributed
+	var serverName string
+	var certSent bool
+	getCertificate := tlsConfig.GetCertificate
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		serverName = hello.ServerName
+		cert, err := getCertificate(hello)
+		certSent = err == nil
+		return cert, err
+	}
+
+	recorder := newAlertRecorder(conn)
+	tlsConn := tls.Server(recorder, tlsConfig)
+
+	conn.SetDeadline(time.Now().Add(SniffTimeout))
+	err := tlsConn.Handshake()
+	recorder.handshakeDone()
+
+	host := serverName
+	if host == "" {
+		host = target
+	}
+
+	if err != nil {
+		err = recorder.handshakeError(err)
+		log.Printf("TLS handshake with client for %s failed: %v\n", target, err)
+
+		// A client that rejects our certificate with an alert most likely
+		// does not trust it or pins the real one
+		var added bool
+		if certSent {
+			added = ps.learnPassthrough(host, err)
+		}
+
+		ps.emitTLSHandshakeFailure(conn, serverName, target, lc, err, added)
+		tlsConn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	ps.acceptedCertificate(host)
+
+	state := tlsConn.ConnectionState()
+
+	// Prefer the SNI name over a bare IP so the upstream handshake carries it too
+	if host, port, err := net.SplitHostPort(target); err == nil && net.ParseIP(host) != nil &&
+		state.ServerName != "" && net.ParseIP(state.ServerName) == nil {
+		target = net.JoinHostPort(state.ServerName, port)
+	}
+
+	handler := ps.connHandler("https", target, lc, hello)
+
+	if state.NegotiatedProtocol == http2.NextProtoTLS {
+		server := &http2.Server{}
+		server.ServeConn(tlsConn, &http2.ServeConnOpts{Handler: handler})
+		tlsConn.Close()
+		return
+	}
+
+	ps.serveHTTPConn(tlsConn, handler)
+}
+
+// connHandler routes requests read from a client connection through the proxy handlers
+func (ps *ProxyServer) connHandler(scheme, target string, lc models.ListenerConfig, hello *models.ClientHello) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := target
+		if host == "" {
+			host = hostWithDefaultPort(r.Host, scheme)
+			if host == "" {
+				http.Error(w, "Missing Host header", http.StatusBadRequest)
+				return
+			}
+		}
+
+		r.URL.Scheme = scheme
+		r.URL.Host = host
+		ctx := context.WithValue(r.Context(), listenerContextKey{}, lc)
+		if hello != nil {
+			ctx = context.WithValue(ctx, clientHelloContextKey{}, hello)
+		}
+		flushStreams(ps.proxy).ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// serveHTTPConn serves HTTP/1.x requests read from conn
+func (ps *ProxyServer) serveHTTPConn(conn net.Conn, handler http.Handler) {
+	server := &http.Server{
+		Handler:  handler,
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+
+	server.Serve(newSingleConnListener(conn))
+}
+
+// hostWithDefaultPort appends the scheme's default port to a Host header value
+func hostWithDefaultPort(host, scheme string) string {
+	if host == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// tunnelConn relays a connection to target without inspecting it. Each
+// direction is half-closed when its sender is done, so a client that shuts
+// down its side after the last request still receives the whole response.
+func (ps *ProxyServer) tunnelConn(conn net.Conn, target string) {
+	defer conn.Close()
+
+	// Start reading the client while dialing, so that the dial is abandoned
+	// if the client goes away. Whatever it sends in the meantime is kept.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := make(chan []byte, 1)
+	firstErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 32*1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			cancel()
+		}
+		first <- buf[:n]
+		firstErr <- err
+	}()
+
+	rule, err := ps.upstreamRule(target)
+	if err != nil {
+		log.Printf("Failed to tunnel to %s: %v\n", target, err)
+		return
+	}
+	upstream, err := dialUpstream(ctx, rule, "tcp", target)
+	if err != nil {
+		log.Printf("Failed to tunnel to %s: %v\n", target, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		if _, err := upstream.Write(<-first); err == nil && <-firstErr == nil {
+			io.Copy(upstream, conn)
+		}
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+
+	<-done
+	<-done
+}
+
+// closeWrite signals the end of the data sent on conn. Connections that cannot
+// be half-closed are closed entirely, which also ends the other direction.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// singleConnListener is a net.Listener that yields one connection and then
+// blocks until that connection is closed
+type singleConnListener struct {
+	conn     net.Conn
+	accepted bool
+	mu       sync.Mutex
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newSingleConnListener creates a listener serving only conn
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{done: make(chan struct{})}
+	l.conn = &closeNotifyConn{Conn: conn, onClose: l.closeDone}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.accepted {
+		l.accepted = true
+		l.mu.Unlock()
+		return l.conn, nil
+	}
+	l.mu.Unlock()
+
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.closeDone()
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *singleConnListener) closeDone() {
+	l.once.Do(func() { close(l.done) })
+}
+
+// closeNotifyConn calls onClose when the connection is closed
+type closeNotifyConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.onClose()
+	return c.Conn.Close()
+}
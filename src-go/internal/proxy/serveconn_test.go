@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestTunnelHalfClose checks that a client that half-closes its side of a
+// tunnel still receives everything the server sends afterwards
+func TestTunnelHalfClose(t *testing.T) {
+	// The server answers only once the client has finished sending
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		time.Sleep(50 * time.Millisecond)
+		conn.Write(append([]byte("echo: "), request...))
+	}()
+
+	ps, err := NewProxyServer(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go func() {
+		conn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		ps.tunnelConn(conn, server.Addr().String())
+	}()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "echo: hello" {
+		t.Errorf("response = %q, want %q", response, "echo: hello")
+	}
+}
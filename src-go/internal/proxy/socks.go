@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socks5Version       = 0x05
+	socksAuthNone       = 0x00
+	socksAuthPassword   = 0x02
+	socksAuthNoMatch    = 0xff
+	socksCmdConnect     = 0x01
+	socksAtypIPv4       = 0x01
+	socksAtypDomain     = 0x03
+	socksAtypIPv6       = 0x04
+	socksReplySuccess   = 0x00
+	socksReplyNotAllow  = 0x02
+	socksReplyCmdUnsupp = 0x07
+	socksReplyAtypUnsup = 0x08
+
+	SOCKSHandshakeTimeout = 30 * time.Second
+)
+
+// serveSOCKS performs the SOCKS5 handshake and feeds the connection into the capture pipeline
+func (ps *ProxyServer) serveSOCKS(conn net.Conn, lc models.ListenerConfig) {
+	target, br, err := socksHandshake(conn, lc.Username, lc.Password)
+	if err != nil {
+		log.Printf("SOCKS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	ps.serveConn(newBufferedConn(conn, br), target, lc)
+}
+
+// socksHandshake negotiates a SOCKS5 CONNECT and returns the requested target
+func socksHandshake(conn net.Conn, username, password string) (string, *bufio.Reader, error) {
+	conn.SetDeadline(time.Now().Add(SOCKSHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", nil, err
+	}
+	if header[0] != socks5Version {
+		return "", nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", nil, err
+	}
+
+	method := byte(socksAuthNone)
+	if username != "" {
+		method = socksAuthPassword
+	}
+
+	offered := false
+	for _, m := range methods {
+		if m == method {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socksAuthNoMatch})
+		return "", nil, errors.New("no acceptable authentication method")
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", nil, err
+	}
+
+	if method == socksAuthPassword {
+		if err := socksAuthenticate(conn, br, username, password); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(br, request); err != nil {
+		return "", nil, err
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksReplyCmdUnsupp)
+		return "", nil, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if request[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", nil, err
+		}
+		host = net.IP(ip).String()
+
+	case socksAtypDomain:
+		length, err := br.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(br, domain); err != nil {
+			return "", nil, err
+		}
+		host = string(domain)
+
+	default:
+		socksReply(conn, socksReplyAtypUnsup)
+		return "", nil, fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(br, portBytes); err != nil {
+		return "", nil, err
+	}
+	port := binary.BigEndian.Uint16(portBytes)
+
+	// The upstream connection is made lazily by the capture pipeline
+	if err := socksReply(conn, socksReplySuccess); err != nil {
+		return "", nil, err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), br, nil
+}
+
+// socksAuthenticate performs username/password sub-negotiation
+func socksAuthenticate(conn net.Conn, br *bufio.Reader, username, password string) error {
+	// VER ULEN UNAME PLEN PASSWD
+	version, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != 0x01 {
+		return fmt.Errorf("unsupported SOCKS auth version %d", version)
+	}
+
+	readField := func() ([]byte, error) {
+		length, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		field := make([]byte, length)
+		_, err = io.ReadFull(br, field)
+		return field, err
+	}
+
+	user, err := readField()
+	if err != nil {
+		return err
+	}
+	pass, err := readField()
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(user, []byte(username)) != 1 ||
+		subtle.ConstantTimeCompare(pass, []byte(password)) != 1 {
+		conn.Write([]byte{0x01, socksReplyNotAllow})
+		return errors.New("invalid SOCKS credentials")
+	}
+
+	_, err = conn.Write([]byte{0x01, socksReplySuccess})
+	return err
+}
+
+// socksReply sends a CONNECT reply with an unspecified bound address
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socks5Version, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
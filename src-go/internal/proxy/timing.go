@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// upstreamTiming collects the phases of an upstream round trip. Trace hooks
+// may fire from the transport's dial goroutines, so fields are guarded by mu.
+type upstreamTiming struct {
+	mu sync.Mutex
+
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	bodyDone     time.Time
+
+	reused     bool
+	remoteAddr net.Addr
+}
+
+// traceRequest attaches a client trace to req that records into a new upstreamTiming
+func traceRequest(req *http.Request) (*http.Request, *upstreamTiming) {
+	t := &upstreamTiming{start: time.Now()}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.mark(&t.dnsDone) },
+		ConnectStart: func(string, string) {
+			t.mark(&t.connectStart)
+		},
+		ConnectDone: func(string, string, error) {
+			t.mark(&t.connectDone)
+		},
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.mark(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.reused = info.Reused
+			t.remoteAddr = info.Conn.RemoteAddr()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// mark records the first time a phase was reached. Happy Eyeballs may dial
+// several addresses, the first attempt is the one that counts.
+func (t *upstreamTiming) mark(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if at.IsZero() {
+		*at = time.Now()
+	}
+}
+
+// apply copies the collected timings and connection info onto details.
+// Safe to call on a nil upstreamTiming.
+func (t *upstreamTiming) apply(details *models.RequestDetails) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	end := t.bodyDone
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	timing := &models.Timing{
+		DNS:     elapsedMillis(t.dnsStart, t.dnsDone),
+		Connect: elapsedMillis(t.connectStart, t.connectDone),
+		TLS:     elapsedMillis(t.tlsStart, t.tlsDone),
+		TTFB:    elapsedMillis(t.wroteRequest, t.firstByte),
+		Total:   elapsedMillis(t.start, end),
+	}
+	if !t.bodyDone.IsZero() {
+		timing.Transfer = elapsedMillis(t.firstByte, t.bodyDone)
+	}
+
+	details.Timing = timing
+	details.ConnectionReused = t.reused
+	if addr, ok := t.remoteAddr.(*net.TCPAddr); ok {
+		details.RemoteIP = addr.IP.String()
+		details.RemotePort = addr.Port
+	}
+}
+
+// elapsedMillis returns the time between two marks, 0 unless both were reached
+func elapsedMillis(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() {
+		return 0
+	}
+	return float64(to.Sub(from).Microseconds()) / 1000
+}
+
+// timedBody marks the end of the body transfer when the upstream body is exhausted
+type timedBody struct {
+	io.ReadCloser
+	timing *upstreamTiming
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.timing.mark(&b.timing.bodyDone)
+	}
+	return n, err
+}
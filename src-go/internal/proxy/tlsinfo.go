@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+// MaxCachedTLSInfos bounds the per-connection TLS metadata cache
+const MaxCachedTLSInfos = 1000
+
+// tlsInfoCache remembers the TLS metadata of upstream connections. Responses
+// on the same connection share one *tls.ConnectionState, so the chain is only
+// inspected and verified once per connection.
+type tlsInfoCache struct {
+	mu    sync.Mutex
+	infos map[*tls.ConnectionState]*models.TLSInfo
+}
+
+// upstreamTLSInfo returns the TLS metadata of the connection a response came
+// over, or nil for plaintext responses
+func (ps *ProxyServer) upstreamTLSInfo(state *tls.ConnectionState, host string) *models.TLSInfo {
+	if state == nil {
+		return nil
+	}
+
+	c := &ps.tlsInfos
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if info, ok := c.infos[state]; ok {
+		return info
+	}
+
+	// Connections are not reported closed, start over instead of growing forever
+	if c.infos == nil || len(c.infos) >= MaxCachedTLSInfos {
+		c.infos = make(map[*tls.ConnectionState]*models.TLSInfo)
+	}
+
+	info := buildTLSInfo(state, host)
+	c.infos[state] = info
+
+	if len(state.PeerCertificates) > 0 && ps.certMgr != nil {
+		ps.certMgr.RememberUpstreamCertificate(stripPort(host), state.PeerCertificates[0])
+	}
+	return info
+}
+
+// buildTLSInfo summarizes a connection state and verifies its chain against
+// the system roots, since the upstream transport itself skips verification
+func buildTLSInfo(state *tls.ConnectionState, host string) *models.TLSInfo {
+	serverName := state.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	info := &models.TLSInfo{
+		Version:      tls.VersionName(state.Version),
+		CipherSuite:  tls.CipherSuiteName(state.CipherSuite),
+		ALPN:         state.NegotiatedProtocol,
+		ServerName:   serverName,
+		Resumed:      state.DidResume,
+		Certificates: make([]models.CertificateInfo, 0, len(state.PeerCertificates)),
+	}
+
+	now := time.Now()
+	for _, cert := range state.PeerCertificates {
+		info.Certificates = append(info.Certificates, certificateInfo(cert, now))
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		info.VerifyError = "no certificates presented"
+		return info
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       stripPort(serverName),
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	})
+	if err != nil {
+		info.VerifyError = err.Error()
+	} else {
+		info.Verified = true
+	}
+
+	return info
+}
+
+// certificateInfo summarizes a single certificate
+func certificateInfo(cert *x509.Certificate, now time.Time) models.CertificateInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+
+	selfSigned := bytes.Equal(cert.RawSubject, cert.RawIssuer) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+
+	return models.CertificateInfo{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		SerialNumber:       cert.SerialNumber.String(),
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		DNSNames:           cert.DNSNames,
+		IPAddresses:        ips,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		PublicKeyAlgorithm: cert.PublicKeyAlgorithm.String(),
+		SHA256:             hex.EncodeToString(fingerprint[:]),
+		SelfSigned:         selfSigned,
+		Expired:            now.After(cert.NotAfter),
+	}
+}
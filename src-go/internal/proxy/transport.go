@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// setupTransports derives the upstream transports from the goproxy transport
+func (ps *ProxyServer) setupTransports() {
+	// Forward the client's Accept-Encoding and relay responses still encoded,
+	// so clients receive the bytes the server sent. goproxy would otherwise
+	// replace it with the transport's gzip and hand clients decoded bodies.
+	// Captures decode their own copy.
+	ps.proxy.KeepAcceptEncoding = true
+	ps.proxy.Tr.DisableCompression = true
+
+	// goproxy's transport has a custom TLS config, which keeps it on HTTP/1.1
+	ps.h2Transport = ps.proxy.Tr.Clone()
+	ps.h2Transport.ForceAttemptHTTP2 = true
+}
+
+// upstreamRoundTripper picks the transport matching the client's HTTP version.
+// HTTP/2 clients get ALPN h2 offered upstream, falling back to HTTP/1.1 if the
+// server does not support it. The round trip is traced into ctx.UserData["timing"].
+func (ps *ProxyServer) upstreamRoundTripper(req *http.Request) goproxy.RoundTripper {
+	var transport http.RoundTripper = ps.proxy.Tr
+	if req.ProtoMajor == 2 {
+		transport = ps.h2Transport
+	}
+
+	return goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		// Present a browser's ClientHello upstream if a fingerprint profile applies
+		transport := transport
+		if impersonator := ps.impersonatorFor(req); impersonator != nil {
+			transport = impersonator
+		}
+
+		req, timing := traceRequest(req)
+		if userData, ok := ctx.UserData.(map[string]interface{}); ok {
+			userData["timing"] = timing
+		}
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// Upgraded connections keep their read-write body for the relay
+		if resp.StatusCode != http.StatusSwitchingProtocols && resp.Body != nil && resp.Body != http.NoBody {
+			resp.Body = &timedBody{ReadCloser: resp.Body, timing: timing}
+		}
+		return resp, nil
+	})
+}
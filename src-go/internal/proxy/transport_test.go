@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestAcceptEncodingPassthrough checks that clients get the encoding they asked
+// for: their Accept-Encoding reaches the server and the response is relayed
+// without being decoded. Clients that ask for none get an identity body.
+func TestAcceptEncodingPassthrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			io.WriteString(w, "hello")
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, "hello")
+		gz.Close()
+	}))
+	defer upstream.Close()
+
+	ps, err := NewProxyServer(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(ps.proxy)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:              http.ProxyURL(proxyURL),
+		DisableCompression: true, // Show the body as the proxy relayed it
+	}}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"client asks for gzip", "gzip, br", "gzip"},
+		{"client asks for nothing", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if got := resp.Header.Get("X-Accept-Encoding"); got != tt.acceptEncoding {
+				t.Errorf("server saw Accept-Encoding %q, want %q", got, tt.acceptEncoding)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+
+			if tt.wantEncoding == "gzip" {
+				gz, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("body is not gzip: %v", err)
+				}
+				body, _ = io.ReadAll(gz)
+			}
+			if string(body) != "hello" {
+				t.Errorf("body = %q, want %q", body, "hello")
+			}
+		})
+	}
+}
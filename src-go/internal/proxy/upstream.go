@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+	netproxy "golang.org/x/net/proxy"
+)
+
+const UpstreamDialTimeout = 30 * time.Second
+
+// setupUpstream routes outbound traffic through the configured upstream proxies
+func (ps *ProxyServer) setupUpstream() {
+	// Plain HTTP and MITM'd HTTPS requests go through the transport
+	ps.proxy.Tr.Proxy = ps.upstreamProxyURL
+
+	// Tunneled CONNECTs dial the target themselves
+	envDial := ps.proxy.ConnectDial
+	ps.proxy.ConnectDialWithReq = func(req *http.Request, network, addr string) (net.Conn, error) {
+		rules := ps.GetConfig().UpstreamProxies
+		if len(rules) == 0 && envDial != nil {
+			return envDial(network, addr)
+		}
+		return dialUpstream(req.Context(), matchUpstream(rules, addr), network, addr)
+	}
+}
+
+// matchUpstream returns the first enabled rule matching the target, or nil
+func matchUpstream(rules []models.UpstreamProxyRule, target string) *models.UpstreamProxyRule {
+	host := stripPort(target)
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Enabled {
+			continue
+		}
+
+		if len(rule.Hosts) == 0 {
+			return rule
+		}
+
+		for _, pattern := range rule.Hosts {
+			if matchesPattern(host, pattern) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// upstreamProxyURL selects the upstream proxy for a transport request
+func (ps *ProxyServer) upstreamProxyURL(req *http.Request) (*url.URL, error) {
+	rules := ps.GetConfig().UpstreamProxies
+	if len(rules) == 0 {
+		// No rules configured, keep honoring HTTP_PROXY and friends
+		return http.ProxyFromEnvironment(req)
+	}
+
+	rule := matchUpstream(rules, req.URL.Host)
+	if rule == nil || rule.Type == models.UpstreamDirect {
+		return nil, nil
+	}
+
+	switch rule.Type {
+	case models.UpstreamHTTP, models.UpstreamSOCKS5:
+		u := &url.URL{Scheme: rule.Type, Host: rule.Address}
+		if rule.Username != "" {
+			u.User = url.UserPassword(rule.Username, rule.Password)
+		}
+		return u, nil
+	default:
+		return nil, fmt.Errorf("unknown upstream proxy type %q", rule.Type)
+	}
+}
+
+// upstreamRule selects the upstream proxy for a connection to addr. Like
+// upstreamProxyURL it falls back to HTTPS_PROXY and friends without rules.
+func (ps *ProxyServer) upstreamRule(addr string) (*models.UpstreamProxyRule, error) {
+	rules := ps.GetConfig().UpstreamProxies
+	if len(rules) > 0 {
+		return matchUpstream(rules, addr), nil
+	}
+
+	u, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil || u == nil {
+		return nil, err
+	}
+
+	rule := &models.UpstreamProxyRule{Enabled: true, Address: u.Host}
+	port := "80"
+	switch u.Scheme {
+	case "http":
+		rule.Type = models.UpstreamHTTP
+	case "socks5", "socks5h":
+		rule.Type = models.UpstreamSOCKS5
+		port = "1080"
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy %s", u.Redacted())
+	}
+	if u.Port() == "" {
+		rule.Address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.User != nil {
+		rule.Username = u.User.Username()
+		rule.Password, _ = u.User.Password()
+	}
+	return rule, nil
+}
+
+// dialUpstream opens a connection to addr, through rule if it is not direct
+func dialUpstream(ctx context.Context, rule *models.UpstreamProxyRule, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: UpstreamDialTimeout}
+
+	if rule == nil || rule.Type == models.UpstreamDirect {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	switch rule.Type {
+	case models.UpstreamHTTP:
+		return dialHTTPConnect(ctx, dialer, rule, network, addr)
+
+	case models.UpstreamSOCKS5:
+		var auth *netproxy.Auth
+		if rule.Username != "" {
+			auth = &netproxy.Auth{User: rule.Username, Password: rule.Password}
+		}
+
+		socks, err := netproxy.SOCKS5("tcp", rule.Address, auth, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
+		}
+
+		conn, err := socks.(netproxy.ContextDialer).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("upstream SOCKS5 proxy %s: %w", rule.Address, err)
+		}
+		return conn, nil
+
+	default:
+		return nil, fmt.Errorf("unknown upstream proxy type %q", rule.Type)
+	}
+}
+
+// dialHTTPConnect opens a tunnel to addr through an HTTP proxy
+func dialHTTPConnect(ctx context.Context, dialer *net.Dialer, rule *models.UpstreamProxyRule, network, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, rule.Address)
+	if err != nil {
+		return nil, fmt.Errorf("upstream HTTP proxy %s: %w", rule.Address, err)
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if rule.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(rule.Username + ":" + rule.Password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to upstream proxy: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from upstream proxy: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT to %s: %s %s", addr, resp.Status, body)
+	}
+
+	return newBufferedConn(conn, br), nil
+}
+
+// bufferedConn is a net.Conn whose reads first drain an existing bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newBufferedConn wraps conn, only keeping the reader if it holds unread bytes
+func newBufferedConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: r}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the wrapped connection
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
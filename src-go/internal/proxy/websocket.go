@@ -0,0 +1,541 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1342tools/kanti/backend/pkg/models"
+)
+
+const (
+	MaxWebSocketFrameSize      = 64 * 1024 * 1024 // 64MB
+	MaxCachedWebSocketMessages = 10000
+)
+
+// WebSocket opcodes (RFC 6455)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+)
+
+// isWebSocketUpgrade reports whether a header carries a WebSocket upgrade
+func isWebSocketUpgrade(header http.Header) bool {
+	return headerHasToken(header, "Connection", "upgrade") && headerHasToken(header, "Upgrade", "websocket")
+}
+
+// headerHasToken checks a comma separated header for a token, ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsFrame is a single WebSocket frame
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte // Unmasked
+	raw     []byte // Frame as read off the wire
+}
+
+// readWSFrame reads one frame from r
+func readWSFrame(r io.Reader) (*wsFrame, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	raw := append([]byte(nil), header...)
+
+	frame := &wsFrame{
+		fin:    header[0]&0x80 != 0,
+		opcode: header[0] & 0x0f,
+	}
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		raw = append(raw, ext...)
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		raw = append(raw, ext...)
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if length > MaxWebSocketFrameSize {
+		return nil, fmt.Errorf("websocket frame of %d bytes exceeds limit", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+		raw = append(raw, mask[:]...)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	raw = append(raw, payload...)
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	frame.payload = payload
+	frame.raw = raw
+	return frame, nil
+}
+
+// encodeWSFrame builds a single unfragmented frame. Frames sent by the client
+// must be masked.
+func encodeWSFrame(opcode byte, payload []byte, masked bool) []byte {
+	frame := []byte{0x80 | opcode}
+
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// encodeWSPayload renders a payload like encodeBody, always using base64 for binary messages
+func encodeWSPayload(opcode byte, payload []byte) (string, string) {
+	if opcode == wsOpBinary {
+		return base64.StdEncoding.EncodeToString(payload), models.EncodingBase64
+	}
+	return encodeBody(payload)
+}
+
+// wsDirection is one direction of a relayed WebSocket connection
+type wsDirection struct {
+	name   string    // One of the models.WS* directions
+	dst    io.Writer // Where frames for this direction are written
+	masked bool      // Frames are masked (client to server)
+
+	mu         sync.Mutex // Serializes relayed and injected frames
+	fragmented bool       // A fragmented message is partially written
+}
+
+// write sends frames in order; more reports whether a fragmented message continues after them
+func (d *wsDirection) write(more bool, frames ...[]byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, frame := range frames {
+		if _, err := d.dst.Write(frame); err != nil {
+			return err
+		}
+	}
+	d.fragmented = more
+
+	return nil
+}
+
+// inject sends a new frame between messages
+func (d *wsDirection) inject(frame []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.fragmented {
+		return errors.New("a fragmented message is being relayed, try again")
+	}
+
+	_, err := d.dst.Write(frame)
+	return err
+}
+
+// wsPendingMessage collects the frames of a data message until it is complete
+type wsPendingMessage struct {
+	opcode  byte
+	payload []byte   // Capped at MaxBodySize
+	length  int      // Full payload size
+	held    bool     // Waiting for an intercept decision once complete
+	frames  [][]byte // Raw frames of a held message
+}
+
+// wsRelay sits between goproxy and the upstream side of an upgraded
+// connection. goproxy writes the client's bytes to it and reads the server's
+// bytes from it, so both directions pass through a frame parser that records
+// every message and, in intercept mode, holds it for review.
+type wsRelay struct {
+	ps       *ProxyServer
+	upstream io.ReadWriteCloser
+	req      *http.Request // Upgrade handshake
+	reqID    int
+
+	clientR *io.PipeReader // Client to server bytes written by goproxy
+	clientW *io.PipeWriter
+	serverR *io.PipeReader // Server to client bytes read by goproxy
+	serverW *io.PipeWriter
+
+	toServer *wsDirection
+	toClient *wsDirection
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newWSRelay starts relaying frames between goproxy and upstream
+func (ps *ProxyServer) newWSRelay(upstream io.ReadWriteCloser, req *http.Request, reqID int) *wsRelay {
+	r := &wsRelay{
+		ps:       ps,
+		upstream: upstream,
+		req:      req,
+		reqID:    reqID,
+		done:     make(chan struct{}),
+	}
+	r.clientR, r.clientW = io.Pipe()
+	r.serverR, r.serverW = io.Pipe()
+	r.toServer = &wsDirection{name: models.WSClientToServer, dst: upstream, masked: true}
+	r.toClient = &wsDirection{name: models.WSServerToClient, dst: r.serverW}
+
+	ps.wsRelaysMu.Lock()
+	ps.wsRelays[reqID] = r
+	ps.wsRelaysMu.Unlock()
+
+	go r.pump(r.clientR, r.toServer)
+	go r.pump(r.upstream, r.toClient)
+
+	return r
+}
+
+func (r *wsRelay) Read(p []byte) (int, error) {
+	return r.serverR.Read(p)
+}
+
+func (r *wsRelay) Write(p []byte) (int, error) {
+	return r.clientW.Write(p)
+}
+
+func (r *wsRelay) Close() error {
+	r.shutdown()
+	return nil
+}
+
+// shutdown tears down both directions once either side goes away
+func (r *wsRelay) shutdown() {
+	r.closeOnce.Do(func() {
+		r.ps.wsRelaysMu.Lock()
+		delete(r.ps.wsRelays, r.reqID)
+		r.ps.wsRelaysMu.Unlock()
+
+		close(r.done)
+		r.clientR.CloseWithError(io.ErrClosedPipe)
+		r.serverW.Close()
+		r.upstream.Close()
+	})
+}
+
+// pump relays frames from src in one direction, recording each complete message
+func (r *wsRelay) pump(src io.Reader, d *wsDirection) {
+	defer r.shutdown()
+
+	br := bufio.NewReader(src)
+
+	// Data messages may be split over several frames, with control frames in between
+	var msg *wsPendingMessage
+
+	for {
+		frame, err := readWSFrame(br)
+		if err != nil {
+			return
+		}
+
+		// Control frames are never held
+		if frame.opcode >= wsOpClose {
+			if err := d.write(msg != nil && !msg.held, frame.raw); err != nil {
+				return
+			}
+			r.record(r.message(d.name, frame.opcode, frame.payload, len(frame.payload)))
+			continue
+		}
+
+		if frame.opcode != wsOpContinuation || msg == nil {
+			msg = &wsPendingMessage{opcode: frame.opcode, held: r.shouldHold(d.name)}
+		}
+
+		msg.length += len(frame.payload)
+		if room := MaxBodySize - len(msg.payload); room > 0 {
+			msg.payload = append(msg.payload, frame.payload[:min(room, len(frame.payload))]...)
+		}
+
+		if msg.held {
+			msg.frames = append(msg.frames, frame.raw)
+
+			// Too large to edit, relay it as it arrives instead
+			if msg.length > MaxBodySize {
+				msg.held = false
+				if err := d.write(!frame.fin, msg.frames...); err != nil {
+					return
+				}
+				msg.frames = nil
+			}
+		} else if err := d.write(!frame.fin, frame.raw); err != nil {
+			return
+		}
+
+		if !frame.fin {
+			continue
+		}
+
+		if msg.held {
+			if err := r.release(d, msg); err != nil {
+				return
+			}
+		} else {
+			r.record(r.message(d.name, msg.opcode, msg.payload, msg.length))
+		}
+		msg = nil
+	}
+}
+
+// shouldHold checks whether messages in a direction go to the intercept queue
+func (r *wsRelay) shouldHold(direction string) bool {
+	cfg := r.ps.GetConfig().Intercept
+	if !cfg.InterceptWebSockets || !interceptsHost(cfg, r.req.Host) {
+		return false
+	}
+
+	if len(cfg.WebSocketDirections) == 0 {
+		return true
+	}
+	for _, d := range cfg.WebSocketDirections {
+		if d == direction {
+			return true
+		}
+	}
+	return false
+}
+
+// release holds a complete message in the intercept queue and relays the decision
+func (r *wsRelay) release(d *wsDirection, msg *wsPendingMessage) error {
+	cfg := r.ps.GetConfig().Intercept
+
+	item := models.InterceptedItem{
+		RequestID: r.reqID,
+		Type:      "websocket",
+		Host:      r.req.Host,
+		Method:    r.req.Method,
+		URL:       r.req.URL.String(),
+		Direction: d.name,
+		Opcode:    int(msg.opcode),
+	}
+	item.Raw, item.Encoding = encodeWSPayload(msg.opcode, msg.payload)
+
+	validate := func(raw []byte) error {
+		if _, err := decodeBody(string(raw), item.Encoding); err != nil {
+			return fmt.Errorf("invalid edited WebSocket payload: %w", err)
+		}
+		return nil
+	}
+
+	decision := r.ps.intercept.hold(item, validate, interceptTimeout(cfg), cfg.TimeoutAction, r.done)
+
+	record := r.message(d.name, msg.opcode, msg.payload, msg.length)
+
+	if decision.action == InterceptActionDrop {
+		record.Dropped = true
+		r.record(record)
+		return nil
+	}
+
+	if decision.raw != nil {
+		payload, err := decodeBody(string(decision.raw), item.Encoding)
+		if err != nil {
+			log.Printf("Intercept: invalid edited WebSocket payload: %v, dropping message\n", err)
+			record.Dropped = true
+			r.record(record)
+			return nil
+		}
+		record = r.message(d.name, msg.opcode, payload, len(payload))
+		record.Edited = true
+		r.record(record)
+		return d.write(false, encodeWSFrame(msg.opcode, payload, d.masked))
+	}
+
+	r.record(record)
+	return d.write(false, msg.frames...)
+}
+
+// inject sends a new message in one direction
+func (r *wsRelay) inject(direction string, opcode byte, payload []byte) error {
+	d := r.toServer
+	if direction == models.WSServerToClient {
+		d = r.toClient
+	}
+
+	if err := d.inject(encodeWSFrame(opcode, payload, d.masked)); err != nil {
+		return err
+	}
+
+	msg := r.message(d.name, opcode, payload, len(payload))
+	msg.Injected = true
+	r.record(msg)
+
+	return nil
+}
+
+// message builds the record of a message
+func (r *wsRelay) message(direction string, opcode byte, payload []byte, length int) models.WebSocketMessage {
+	msg := models.WebSocketMessage{
+		RequestID: r.reqID,
+		Host:      r.req.Host,
+		Direction: direction,
+		Opcode:    int(opcode),
+		Timestamp: time.Now(),
+		Length:    length,
+	}
+	msg.Payload, msg.Encoding = encodeWSPayload(opcode, payload)
+
+	return msg
+}
+
+// record stores a message if its host is in scope
+func (r *wsRelay) record(msg models.WebSocketMessage) {
+	if r.ps.shouldSave(r.req.URL) {
+		r.ps.emitWebSocketMessage(msg)
+	}
+}
+
+// wsHistory is a circular buffer of the most recent WebSocket messages
+type wsHistory struct {
+	mu       sync.RWMutex
+	nextID   int64
+	messages []models.WebSocketMessage
+	head     int
+}
+
+// add assigns the message an ID and stores it, evicting the oldest when full
+func (h *wsHistory) add(msg models.WebSocketMessage) models.WebSocketMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	msg.ID = h.nextID
+
+	if len(h.messages) < MaxCachedWebSocketMessages {
+		h.messages = append(h.messages, msg)
+	} else {
+		h.messages[h.head] = msg
+		h.head = (h.head + 1) % MaxCachedWebSocketMessages
+	}
+
+	return msg
+}
+
+// list returns the stored messages oldest first, optionally for one handshake
+func (h *wsHistory) list(requestID int) []models.WebSocketMessage {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := make([]models.WebSocketMessage, 0, len(h.messages))
+	for i := range h.messages {
+		msg := h.messages[(h.head+i)%len(h.messages)]
+		if requestID == 0 || msg.RequestID == requestID {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// clear removes all stored messages
+func (h *wsHistory) clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.messages = nil
+	h.head = 0
+}
+
+// emitWebSocketMessage stores a message and notifies listeners
+func (ps *ProxyServer) emitWebSocketMessage(msg models.WebSocketMessage) {
+	msg = ps.wsHistory.add(msg)
+
+	if ps.onWebSocketMessage != nil {
+		ps.onWebSocketMessage(msg)
+	}
+}
+
+// InjectWebSocketMessage sends a new message over an open WebSocket connection,
+// identified by its handshake request ID. Text messages use wsOpText (1) and
+// binary ones wsOpBinary (2).
+func (ps *ProxyServer) InjectWebSocketMessage(requestID int, direction string, opcode int, payload []byte) error {
+	if direction != models.WSClientToServer && direction != models.WSServerToClient {
+		return fmt.Errorf("invalid direction %q", direction)
+	}
+	if opcode != wsOpText && opcode != wsOpBinary {
+		return fmt.Errorf("invalid opcode %d", opcode)
+	}
+
+	ps.wsRelaysMu.Lock()
+	r, ok := ps.wsRelays[requestID]
+	ps.wsRelaysMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no open WebSocket connection for request %d", requestID)
+	}
+
+	return r.inject(direction, byte(opcode), payload)
+}
+
+// GetWebSocketMessages returns captured WebSocket messages oldest first.
+// A non-zero requestID limits the result to one upgraded connection.
+func (ps *ProxyServer) GetWebSocketMessages(requestID int) []models.WebSocketMessage {
+	return ps.wsHistory.list(requestID)
+}
+
+// SetOnWebSocketMessage sets the callback for captured WebSocket messages
+func (ps *ProxyServer) SetOnWebSocketMessage(callback func(models.WebSocketMessage)) {
+	ps.onWebSocketMessage = callback
+}
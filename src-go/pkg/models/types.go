@@ -5,41 +5,387 @@ import (
 	"time"
 )
 
+// EncodingBase64 marks a body or payload that is base64 encoded because it is not UTF-8 text
+const EncodingBase64 = "base64"
+
 // RequestDetails represents a captured HTTP request/response
 type RequestDetails struct {
-	ID              int         `json:"id"`
-	Host            string      `json:"host"`
-	Method          string      `json:"method"`
-	Path            string      `json:"path"`
-	Query           string      `json:"query,omitempty"`
-	Headers         http.Header `json:"headers"`
-	Timestamp       time.Time   `json:"timestamp"`
-	ResponseLength  int         `json:"responseLength"`
-	Status          int         `json:"status"`
-	ResponseTime    int64       `json:"responseTime"` // milliseconds
-	Protocol        string      `json:"protocol"`     // "http" or "https"
-	Body            string      `json:"body,omitempty"`
-	ResponseBody    string      `json:"responseBody,omitempty"`
-	ResponseHeaders http.Header `json:"responseHeaders,omitempty"`
-	Error           string      `json:"error,omitempty"`
+	ID                   int          `json:"id"`
+	Host                 string       `json:"host"`
+	Method               string       `json:"method"`
+	Path                 string       `json:"path"`
+	Query                string       `json:"query,omitempty"`
+	Headers              http.Header  `json:"headers"`
+	Timestamp            time.Time    `json:"timestamp"`
+	ResponseLength       int          `json:"responseLength"`
+	Status               int          `json:"status"`
+	ResponseTime         int64        `json:"responseTime"`               // milliseconds
+	Timing               *Timing      `json:"timing,omitempty"`           // Breakdown of the upstream round trip
+	ConnectionReused     bool         `json:"connectionReused,omitempty"` // Sent over an idle upstream connection
+	RemoteIP             string       `json:"remoteIp,omitempty"`         // Address the upstream connection went to
+	RemotePort           int          `json:"remotePort,omitempty"`
+	Protocol             string       `json:"protocol"`                      // "http" or "https"
+	HTTPVersion          string       `json:"httpVersion,omitempty"`         // Client side, e.g. "HTTP/2.0"
+	UpstreamVersion      string       `json:"upstreamHttpVersion,omitempty"` // Server side of the response
+	UpstreamTLS          *TLSInfo     `json:"upstreamTls,omitempty"`         // Connection to the real server
+	ClientTLS            *ClientHello `json:"clientTls,omitempty"`           // ClientHello of the intercepted client connection
+	Body                 string       `json:"body,omitempty"`
+	BodyEncoding         string       `json:"bodyEncoding,omitempty"`  // EncodingBase64 when the body is not UTF-8 text
+	BodyTruncated        bool         `json:"bodyTruncated,omitempty"` // Body exceeded the capture limit
+	ResponseBody         string       `json:"responseBody,omitempty"`
+	ResponseBodyEncoding string       `json:"responseBodyEncoding,omitempty"`
+	ResponseTruncated    bool         `json:"responseTruncated,omitempty"`
+	DecodeError          string       `json:"decodeError,omitempty"` // Content-Encoding could not be undone, ResponseBody is still encoded
+	ResponseHeaders      http.Header  `json:"responseHeaders,omitempty"`
+	Error                string       `json:"error,omitempty"`
+	ErrorType            string       `json:"errorType,omitempty"` // One of the Error* types for upstream failures
+	Listener             string       `json:"listener,omitempty"`  // ID of the listener the request came through
+	Intercepted          bool         `json:"intercepted,omitempty"`
+	InterceptAction      string       `json:"interceptAction,omitempty"` // How the held request was resolved: forward, drop or timeout
+	HeldTime             int64        `json:"heldTime,omitempty"`        // milliseconds held for review
+	AppliedRules         []string     `json:"appliedRules,omitempty"`    // Match-and-replace rules that fired
+	AddedHeaders         []string     `json:"addedHeaders,omitempty"`    // Request headers set by the proxy
+	RemovedHeaders       []string     `json:"removedHeaders,omitempty"`  // Request headers stripped by the proxy
+	ReplacedHeaders      []string     `json:"replacedHeaders,omitempty"` // Request headers whose client value the proxy overwrote
+}
+
+// Timing breaks down an upstream round trip, in fractional milliseconds.
+// Phases that did not happen, such as DNS on a reused connection, are 0.
+type Timing struct {
+	DNS      float64 `json:"dns"`
+	Connect  float64 `json:"connect"`
+	TLS      float64 `json:"tls"`
+	TTFB     float64 `json:"ttfb"`     // Request fully written until the first response byte
+	Transfer float64 `json:"transfer"` // First response byte until the body was read
+	Total    float64 `json:"total"`    // Start of the round trip until the body was read
+}
+
+// TLSInfo describes a TLS connection to an upstream server
+type TLSInfo struct {
+	Version      string            `json:"version"` // e.g. "TLS 1.3"
+	CipherSuite  string            `json:"cipherSuite"`
+	ALPN         string            `json:"alpn,omitempty"`
+	ServerName   string            `json:"serverName,omitempty"`
+	Resumed      bool              `json:"resumed,omitempty"`
+	Verified     bool              `json:"verified"` // Chain is trusted by the system roots and valid for the host
+	VerifyError  string            `json:"verifyError,omitempty"`
+	Certificates []CertificateInfo `json:"certificates"` // As sent by the server, leaf first
+}
+
+// ClientHello describes the TLS ClientHello a client sent to the proxy
+type ClientHello struct {
+	ServerName       string   `json:"serverName,omitempty"`
+	ALPN             []string `json:"alpn,omitempty"`
+	Versions         []string `json:"versions"`     // Offered TLS versions, highest preference first
+	CipherSuites     []string `json:"cipherSuites"` // In the client's order, GREASE values removed
+	Extensions       []uint16 `json:"extensions"`   // Extension IDs in the client's order, GREASE values removed
+	SupportedGroups  []uint16 `json:"supportedGroups,omitempty"`
+	SignatureSchemes []uint16 `json:"signatureSchemes,omitempty"`
+	JA3              string   `json:"ja3"`
+	JA3Hash          string   `json:"ja3Hash"`
+	JA4              string   `json:"ja4"`
+}
+
+// CertificateInfo summarizes an X.509 certificate
+type CertificateInfo struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	SerialNumber       string    `json:"serialNumber"`
+	NotBefore          time.Time `json:"notBefore"`
+	NotAfter           time.Time `json:"notAfter"`
+	DNSNames           []string  `json:"dnsNames,omitempty"`
+	IPAddresses        []string  `json:"ipAddresses,omitempty"`
+	SignatureAlgorithm string    `json:"signatureAlgorithm"`
+	PublicKeyAlgorithm string    `json:"publicKeyAlgorithm"`
+	SHA256             string    `json:"sha256"` // Hex fingerprint of the DER encoding
+	SelfSigned         bool      `json:"selfSigned,omitempty"`
+	Expired            bool      `json:"expired,omitempty"`
 }
 
 // ProxyConfig holds proxy server configuration
 type ProxyConfig struct {
-	Port            int               `json:"port"`
-	SSLInterception bool              `json:"sslInterception"`
-	CustomHeaders   map[string]string `json:"customHeaders"`
-	SaveOnlyInScope bool              `json:"saveOnlyInScope"`
-	InScope         []string          `json:"inScope"`
-	OutOfScope      []string          `json:"outOfScope"`
-	CertPath        string            `json:"certPath"`
+	Port            int                 `json:"port"`
+	SSLInterception bool                `json:"sslInterception"`
+	CustomHeaders   map[string]string   `json:"customHeaders"`
+	SaveOnlyInScope bool                `json:"saveOnlyInScope"`
+	InScope         []string            `json:"inScope"`
+	OutOfScope      []string            `json:"outOfScope"`
+	ScopeRules      []ScopeRule         `json:"scopeRules"` // Evaluated together with InScope and OutOfScope
+	CertPath        string              `json:"certPath"`
+	Intercept       InterceptConfig     `json:"intercept"`
+	MatchReplace    []MatchReplaceRule  `json:"matchReplace"`
+	UpstreamProxies []UpstreamProxyRule `json:"upstreamProxies"` // First matching rule wins
+	Listeners       []ListenerConfig    `json:"listeners"`       // Additional listeners next to Port
+	DisableHTTP2    bool                `json:"disableHTTP2"`    // Only offer HTTP/1.1 to intercepted clients
+	MaxCaptureSize  int                 `json:"maxCaptureSize"`  // Bytes of each body to record (0 = 10MB)
+
+	HeaderSanitization   HeaderSanitization `json:"headerSanitization"`
+	TLSPassthrough       TLSPassthrough     `json:"tlsPassthrough"`
+	WildcardCertificates bool               `json:"wildcardCertificates"` // Issue *.parent leaf certificates instead of one per host
+	CopyUpstreamSANs     bool               `json:"copyUpstreamSANs"`     // Give leaves the SANs of the real certificate once known
+	LeafKeyType          string             `json:"leafKeyType"`          // One of the LeafKey* types (empty = RSA)
+	LeafCacheSize        int                `json:"leafCacheSize"`        // Leaf certificates kept in memory (0 = 1000)
+	PersistLeafCerts     bool               `json:"persistLeafCerts"`     // Reuse leaf certificates across restarts
+
+	TLSFingerprint      string               `json:"tlsFingerprint"`      // Upstream ClientHello profile, one of the Fingerprint* constants
+	TLSFingerprintRules []TLSFingerprintRule `json:"tlsFingerprintRules"` // Per-host profiles, first matching rule wins
+}
+
+// HeaderSanitization controls how the proxy cleans up outgoing request headers.
+// The zero value strips proxy-revealing headers and fills in browser defaults.
+type HeaderSanitization struct {
+	DisableStrip  bool              `json:"disableStrip"`  // Keep proxy-revealing headers
+	DisableInject bool              `json:"disableInject"` // Never add missing headers
+	StripHeaders  []string          `json:"stripHeaders"`  // Headers to remove (null = built-in list)
+	InjectHeaders map[string]string `json:"injectHeaders"` // Headers to add when missing (null = built-in browser headers)
+}
+
+// TLSPassthrough selects TLS connections that are tunneled without decryption
+type TLSPassthrough struct {
+	Hosts      []string `json:"hosts"`      // Host patterns that are never intercepted
+	OutOfScope bool     `json:"outOfScope"` // Tunnel every host that cannot be in scope
+	AutoAdd    bool     `json:"autoAdd"`    // Learn hosts whose clients reject the Kanti certificate
+}
+
+// PassthroughHost is a host learned to reject the Kanti certificate
+type PassthroughHost struct {
+	Host    string    `json:"host"`
+	AddedAt time.Time `json:"addedAt"`
+	Error   string    `json:"error"` // Handshake failure that added the host
+}
+
+// Leaf certificate key types
+const (
+	LeafKeyRSA   = "rsa"   // RSA 2048, served from a pre-generated pool
+	LeafKeyECDSA = "ecdsa" // ECDSA P-256
+)
+
+// CA sources
+const (
+	CASourceGenerated = "generated"
+	CASourceImported  = "imported"
+)
+
+// CAInfo describes a CA certificate Kanti signs leaf certificates with
+type CAInfo struct {
+	Subject      string     `json:"subject"`
+	SerialNumber string     `json:"serialNumber"`
+	KeyAlgorithm string     `json:"keyAlgorithm"`
+	SHA1         string     `json:"sha1"`
+	SHA256       string     `json:"sha256"`
+	NotBefore    time.Time  `json:"notBefore"`
+	NotAfter     time.Time  `json:"notAfter"`
+	Expired      bool       `json:"expired"`
+	DaysLeft     int        `json:"daysLeft"` // Whole days until NotAfter, negative once expired
+	Source       string     `json:"source"`   // One of the CASource* constants, empty if unknown
+	ActivatedAt  time.Time  `json:"activatedAt"`
+	RetiredAt    *time.Time `json:"retiredAt,omitempty"` // Unset for the CA in use
+	Certificate  string     `json:"certificate"`         // PEM encoded
+}
+
+// CA export formats
+const (
+	CAFormatPEM    = "pem"
+	CAFormatDER    = "der"
+	CAFormatPKCS12 = "p12" // Certificate and private key, password protected
+)
+
+// Upstream TLS fingerprint profiles
+const (
+	FingerprintGo      = "go" // Go's own ClientHello, the default
+	FingerprintChrome  = "chrome"
+	FingerprintFirefox = "firefox"
+	FingerprintSafari  = "safari"
+	FingerprintAuto    = "auto" // Follow the browser named in the request's User-Agent
+)
+
+// TLSFingerprintRule selects the upstream ClientHello profile for matching hosts
+type TLSFingerprintRule struct {
+	Enabled bool     `json:"enabled"`
+	Hosts   []string `json:"hosts"`   // Host patterns the rule applies to (empty = all)
+	Profile string   `json:"profile"` // One of the Fingerprint* constants
+}
+
+// Scope rule actions
+const (
+	ScopeInclude = "include"
+	ScopeExclude = "exclude" // Takes precedence over includes
+)
+
+// ScopeRule matches requests by URL. Every field that is set must match.
+type ScopeRule struct {
+	Enabled    bool   `json:"enabled"`
+	Action     string `json:"action"`           // One of the Scope* actions
+	Scheme     string `json:"scheme,omitempty"` // "http" or "https" (empty = any)
+	Host       string `json:"host,omitempty"`   // Glob such as *.example.com, or a regex if HostRegex (empty = any)
+	HostRegex  bool   `json:"hostRegex,omitempty"`
+	Port       int    `json:"port,omitempty"` // 0 = any
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	PathRegex  string `json:"pathRegex,omitempty"`
+	CIDR       string `json:"cidr,omitempty"` // IP address or range the host must be a literal IP in, names are not resolved
+}
+
+// Listener modes
+const (
+	ListenerRegular   = "regular"   // HTTP proxy protocol
+	ListenerInvisible = "invisible" // Raw HTTP/TLS from clients that are not proxy-aware
+	ListenerSOCKS     = "socks"     // SOCKS5
+)
+
+// DefaultListenerID identifies the listener started on ProxyConfig.Port. It is
+// reserved, configured listeners may not use it.
+const DefaultListenerID = "default"
+
+// ListenerConfig configures a single proxy listener
+type ListenerConfig struct {
+	ID              string `json:"id"`
+	BindAddress     string `json:"bindAddress"` // Empty = all interfaces
+	Port            int    `json:"port"`
+	Mode            string `json:"mode"` // One of the Listener* modes
+	SSLInterception bool   `json:"sslInterception"`
+	AutoStart       bool   `json:"autoStart"`          // Start together with the proxy
+	Username        string `json:"username,omitempty"` // SOCKS authentication, empty = none
+	Password        string `json:"password,omitempty"`
+}
+
+// ListenerStatus reports the state of a listener
+type ListenerStatus struct {
+	ListenerConfig
+	IsRunning bool `json:"isRunning"`
+}
+
+// Upstream proxy types
+const (
+	UpstreamDirect = "direct"
+	UpstreamHTTP   = "http"
+	UpstreamSOCKS5 = "socks5"
+)
+
+// UpstreamProxyRule routes matching hosts through another proxy
+type UpstreamProxyRule struct {
+	Enabled  bool     `json:"enabled"`
+	Hosts    []string `json:"hosts"`   // Host patterns the rule applies to (empty = all)
+	Type     string   `json:"type"`    // "direct", "http" or "socks5"
+	Address  string   `json:"address"` // host:port of the upstream proxy
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+}
+
+// Match-and-replace rule targets
+const (
+	TargetRequestLine    = "request-line"
+	TargetRequestHeader  = "request-header"
+	TargetRequestBody    = "request-body"
+	TargetResponseStatus = "response-status"
+	TargetResponseHeader = "response-header"
+	TargetResponseBody   = "response-body"
+)
+
+// MatchReplaceRule rewrites part of a request or response
+type MatchReplaceRule struct {
+	ID          string   `json:"id"`
+	Enabled     bool     `json:"enabled"`
+	Description string   `json:"description,omitempty"`
+	Target      string   `json:"target"`          // One of the Target* constants
+	Match       string   `json:"match"`           // Empty match on a header target adds Replace as a new header
+	Replace     string   `json:"replace"`         // Regex rules may reference capture groups ($1, ${name})
+	Regex       bool     `json:"regex"`           // Literal match when false
+	Hosts       []string `json:"hosts,omitempty"` // Host patterns the rule applies to (empty = all)
+}
+
+// InterceptConfig holds intercept mode settings
+type InterceptConfig struct {
+	Enabled               bool     `json:"enabled"`
+	InterceptResponses    bool     `json:"interceptResponses"`
+	Hosts                 []string `json:"hosts"`                 // Host patterns to intercept (empty = all)
+	AutoForwardHosts      []string `json:"autoForwardHosts"`      // Host patterns forwarded without holding
+	AutoForwardMethods    []string `json:"autoForwardMethods"`    // e.g. "OPTIONS"
+	AutoForwardExtensions []string `json:"autoForwardExtensions"` // e.g. ".js", ".png"
+	TimeoutSeconds        int      `json:"timeoutSeconds"`        // 0 = default timeout
+	TimeoutAction         string   `json:"timeoutAction"`         // "forward" or "drop"
+	InterceptWebSockets   bool     `json:"interceptWebSockets"`   // Hold WebSocket messages on intercepted connections
+	WebSocketDirections   []string `json:"webSocketDirections"`   // WS* directions to hold (empty = both)
+}
+
+// InterceptedItem represents a request or response held in the intercept queue
+type InterceptedItem struct {
+	ID        int64     `json:"id"`
+	RequestID int       `json:"requestId"`
+	Type      string    `json:"type"` // "request", "response" or "websocket"
+	Host      string    `json:"host"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Status    int       `json:"status,omitempty"`
+	Direction string    `json:"direction,omitempty"` // WebSocket messages only
+	Opcode    int       `json:"opcode,omitempty"`
+	Encoding  string    `json:"encoding,omitempty"` // EncodingBase64 when Raw is not UTF-8 text; edits use the same encoding
+	Raw       string    `json:"raw"`
+	Edited    bool      `json:"edited"`
+	Timestamp time.Time `json:"timestamp"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Action    string    `json:"action,omitempty"` // "forward", "drop" or "timeout" once resolved
+}
+
+// Upstream error types
+const (
+	ErrorDNS     = "dns"
+	ErrorConnect = "connect"
+	ErrorTLS     = "tls"
+	ErrorTimeout = "timeout"
+	ErrorReset   = "reset"
+	ErrorOther   = "other"
+)
+
+// TLSHandshakeFailure is a client that failed the TLS handshake with the proxy,
+// typically because it does not trust the Kanti CA
+type TLSHandshakeFailure struct {
+	Timestamp  time.Time `json:"timestamp"`
+	ClientAddr string    `json:"clientAddr"`
+	ServerName string    `json:"serverName,omitempty"` // SNI sent by the client
+	Target     string    `json:"target,omitempty"`     // host:port the client was connecting to
+	Listener   string    `json:"listener"`
+	Error      string    `json:"error"`
+
+	AddedToPassthrough bool `json:"addedToPassthrough,omitempty"` // Future connections are tunneled
+}
+
+// ResponseChunk is a piece of a streaming response body, published as it arrives
+type ResponseChunk struct {
+	RequestID int       `json:"requestId"`
+	Offset    int64     `json:"offset"` // Position of Data in the body
+	Data      string    `json:"data"`
+	Encoding  string    `json:"encoding,omitempty"` // EncodingBase64 when Data is not UTF-8 text
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// WebSocket message directions
+const (
+	WSClientToServer = "client-to-server"
+	WSServerToClient = "server-to-client"
+)
+
+// WebSocketMessage is a message sent over a proxied WebSocket connection
+type WebSocketMessage struct {
+	ID        int64     `json:"id"`
+	RequestID int       `json:"requestId"` // Upgrade handshake request
+	Host      string    `json:"host"`
+	Direction string    `json:"direction"` // One of the WS* directions
+	Opcode    int       `json:"opcode"`    // 1 text, 2 binary, 8 close, 9 ping, 10 pong
+	Timestamp time.Time `json:"timestamp"`
+	Payload   string    `json:"payload"`
+	Encoding  string    `json:"encoding,omitempty"` // EncodingBase64 when the payload is not text
+	Length    int       `json:"length"`             // Payload size in bytes
+	Edited    bool      `json:"edited,omitempty"`
+	Dropped   bool      `json:"dropped,omitempty"`
+	Injected  bool      `json:"injected,omitempty"`
 }
 
 // ProxyStatus represents the current state of the proxy
 type ProxyStatus struct {
-	IsRunning       bool   `json:"isRunning"`
-	Port            int    `json:"port"`
-	CertificatePath string `json:"certificatePath"`
+	IsRunning       bool             `json:"isRunning"`
+	Port            int              `json:"port"`
+	CertificatePath string           `json:"certificatePath"`
+	Listeners       []ListenerStatus `json:"listeners"`
 }
 
 // IPCMessage represents a message sent over IPC
@@ -2,6 +2,7 @@ import { spawn, ChildProcess } from 'child_process';
 import { app, BrowserWindow } from 'electron';
 import path from 'path';
 import fs from 'fs';
+import crypto from 'crypto';
 
 export interface GoProxyStatus {
   isRunning: boolean;
@@ -20,8 +21,10 @@ export interface GoProxyConfig {
 
 export class GoBackendManager {
   private process: ChildProcess | null = null;
-  private baseUrl = 'http://localhost:9090';
+  private baseUrl = 'http://127.0.0.1:9090';
   private ipcPort = 9090;
+  // Session token the backend requires on every IPC request
+  private ipcToken = crypto.randomBytes(32).toString('hex');
   private isReady = false;
   private eventSource: any = null;
   private reconnectAttempts = 0;
@@ -51,7 +54,9 @@ export class GoBackendManager {
       '-data', dataDir,
       '-ipc-port', this.ipcPort.toString(),
     ], {
-      stdio: ['ignore', 'pipe', 'pipe']
+      stdio: ['ignore', 'pipe', 'pipe'],
+      // Passed through the environment to keep it out of the process list
+      env: { ...process.env, KANTI_IPC_TOKEN: this.ipcToken },
     });
 
     if (this.process.stdout) {
@@ -313,7 +318,10 @@ export class GoBackendManager {
     try {
       const response = await fetch(url, {
         method,
-        headers: body ? { 'Content-Type': 'application/json' } : {},
+        headers: {
+          ...this.authHeaders(),
+          ...(body ? { 'Content-Type': 'application/json' } : {}),
+        },
         body: body ? JSON.stringify(body) : undefined,
       });
 
@@ -330,13 +338,20 @@ export class GoBackendManager {
     }
   }
 
+  // Headers authenticating a request to the backend
+  private authHeaders(): Record<string, string> {
+    return { Authorization: `Bearer ${this.ipcToken}` };
+  }
+
   private async waitForReady(): Promise<void> {
     const maxAttempts = 100; // 10 seconds
     const delayMs = 100;
 
     for (let i = 0; i < maxAttempts; i++) {
       try {
-        const response = await fetch(`${this.baseUrl}/api/proxy/status`);
+        const response = await fetch(`${this.baseUrl}/api/proxy/status`, {
+          headers: this.authHeaders(),
+        });
         if (response.ok) {
           return;
         }
@@ -374,7 +389,7 @@ export class GoBackendManager {
       console.log(`Event stream URL: ${eventStreamUrl}`);
       
       // Use fetch with streaming for SSE
-      fetch(eventStreamUrl).then(response => {
+      fetch(eventStreamUrl, { headers: this.authHeaders() }).then(response => {
         if (!response.ok) {
           console.error('Failed to connect to event stream:', response.statusText);
           this.scheduleReconnect();